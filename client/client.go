@@ -0,0 +1,311 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLockNotHeld is returned when attempting to renew or unlock a
+	// mutex that isn't held (e.g., it expired)
+	ErrLockNotHeld = errors.New("lock not held")
+
+	// ErrLocked is returned when the lock couldn't be acquired before
+	// the (server side) timeout
+	ErrLocked = errors.New("timed out waiting for lock")
+)
+
+// Configuration describes how to connect to the lock service and the
+// lock (by name) that the mutex will acquire
+type Configuration struct {
+	Address          string        `json:"address"`
+	Name             string        `json:"name"`
+	Owner            string        `json:"owner"`
+	TTL              time.Duration `json:"ttl"`
+	Timeout          time.Duration `json:"timeout"`
+	RenewInterval    time.Duration `json:"renew_interval"`
+	RetryInterval    time.Duration `json:"retry_interval"`
+	MaxRetryInterval time.Duration `json:"max_retry_interval"`
+	MaxRetries       int           `json:"max_retries"`
+}
+
+type lockRequest struct {
+	Owner   string `json:"owner,omitempty"`
+	Token   string `json:"token,omitempty"`
+	TTL     int64  `json:"ttl_ms,omitempty"`
+	Timeout int64  `json:"timeout_ms,omitempty"`
+}
+
+type lockResponse struct {
+	Name    string `json:"name"`
+	Owner   string `json:"owner,omitempty"`
+	Token   string `json:"token,omitempty"`
+	TTL     int64  `json:"ttl_ms"`
+	Waiters int    `json:"waiters"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Mutex is a distributed mutex that's acquired through the lock service,
+// once locked, the mutex will be renewed in the background until it's
+// unlocked; transient errors (e.g., network errors or an unavailable
+// server) are retried except when acquiring the lock: if the response to
+// an acquire is lost the lock may have been granted, retrying would leave
+// that lock orphaned (until its ttl expires)
+type Mutex struct {
+	mu           sync.Mutex
+	config       Configuration
+	httpClient   *http.Client
+	token        string
+	stopper      chan struct{}
+	stopped      chan struct{}
+	lost         chan struct{}
+	errorHandler func(error)
+}
+
+func NewMutex(config Configuration) *Mutex {
+	if config.TTL <= 0 {
+		config.TTL = 10 * time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	if config.RenewInterval <= 0 {
+		config.RenewInterval = config.TTL / 3
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 100 * time.Millisecond
+	}
+	if config.MaxRetryInterval <= 0 {
+		config.MaxRetryInterval = 5 * time.Second
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = 3
+	}
+	return &Mutex{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: config.Timeout + config.TTL,
+		},
+		errorHandler: func(err error) {
+			fmt.Printf("remote error: %s\n", err.Error())
+		},
+	}
+}
+
+// transient returns true if the error (or status code) describes a
+// failure that's likely to succeed if retried
+func transient(err error, statusCode int) bool {
+	var netError net.Error
+
+	switch {
+	case err != nil:
+		return errors.As(err, &netError) || errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, io.EOF)
+	case statusCode == http.StatusBadGateway, statusCode == http.StatusServiceUnavailable,
+		statusCode == http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryInterval returns how long to wait before the given (zero based)
+// retry, the interval doubles with each retry up to the max retry interval
+func (m *Mutex) retryInterval(retry int) time.Duration {
+	d := m.config.RetryInterval
+	for i := 0; i < retry && d < m.config.MaxRetryInterval; i++ {
+		d *= 2
+	}
+	return min(d, m.config.MaxRetryInterval)
+}
+
+// do will execute the request against the lock service, if retry is true
+// transient errors are retried up to the max retries
+func (m *Mutex) do(ctx context.Context, method string, request *lockRequest, retry bool) (*lockResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	uri := m.config.Address + "/locks/" + url.PathEscape(m.config.Name)
+	for i := 0; ; i++ {
+		httpRequest, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpRequest.Header.Set("Content-Type", "application/json")
+		response, statusCode, err := m.roundTrip(httpRequest)
+		if retry && transient(err, statusCode) && i < m.config.MaxRetries && ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(m.retryInterval(i)):
+			}
+			continue
+		}
+		return response, err
+	}
+}
+
+func (m *Mutex) roundTrip(httpRequest *http.Request) (*lockResponse, int, error) {
+	httpResponse, err := m.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpResponse.Body.Close()
+	bytes, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, httpResponse.StatusCode, err
+	}
+	switch httpResponse.StatusCode {
+	case http.StatusOK:
+		response := &lockResponse{}
+		if err := json.Unmarshal(bytes, response); err != nil {
+			return nil, httpResponse.StatusCode, err
+		}
+		return response, httpResponse.StatusCode, nil
+	case http.StatusNoContent:
+		return &lockResponse{}, httpResponse.StatusCode, nil
+	case http.StatusConflict, http.StatusNotFound:
+		return nil, httpResponse.StatusCode, ErrLockNotHeld
+	case http.StatusLocked:
+		return nil, httpResponse.StatusCode, ErrLocked
+	default:
+		response := &errorResponse{}
+		if err := json.Unmarshal(bytes, response); err != nil || response.Error == "" {
+			return nil, httpResponse.StatusCode, fmt.Errorf("unexpected status: %s", httpResponse.Status)
+		}
+		return nil, httpResponse.StatusCode, errors.New(response.Error)
+	}
+}
+
+// renew will periodically renew the lock until stopped, if the lock
+// can't be renewed (e.g., it expired), renewal will stop and lost will
+// be closed
+func (m *Mutex) renew(token string, stopper <-chan struct{}, stopped, lost chan<- struct{}) {
+	defer close(stopped)
+
+	tRenew := time.NewTicker(m.config.RenewInterval)
+	defer tRenew.Stop()
+	for {
+		select {
+		case <-stopper:
+			return
+		case <-tRenew.C:
+			ctx, cancel := context.WithTimeout(context.Background(), m.config.RenewInterval)
+			_, err := m.do(ctx, http.MethodPut, &lockRequest{
+				Token: token,
+				TTL:   m.config.TTL.Milliseconds(),
+			}, true)
+			cancel()
+			switch {
+			case errors.Is(err, ErrLockNotHeld):
+				m.errorHandler(err)
+				close(lost)
+				return
+			case err != nil:
+				m.errorHandler(err)
+			}
+		}
+	}
+}
+
+// LockContext will attempt to lock the mutex until successful or the
+// context is done
+func (m *Mutex) LockContext(ctx context.Context) error {
+	for {
+		response, err := m.do(ctx, http.MethodPost, &lockRequest{
+			Owner:   m.config.Owner,
+			TTL:     m.config.TTL.Milliseconds(),
+			Timeout: m.config.Timeout.Milliseconds(),
+		}, false)
+		if errors.Is(err, ErrLocked) && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		stopper, stopped, lost := make(chan struct{}), make(chan struct{}), make(chan struct{})
+		go m.renew(response.Token, stopper, stopped, lost)
+		m.mu.Lock()
+		m.token, m.stopper, m.stopped, m.lost = response.Token, stopper, stopped, lost
+		m.mu.Unlock()
+		return nil
+	}
+}
+
+// Lost returns a channel that's closed if the lock is lost while it's held
+// (e.g., it couldn't be renewed before its ttl expired), the critical
+// section should be stopped since someone else may hold the lock; if the
+// mutex isn't locked, nil is returned
+func (m *Mutex) Lost() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lost
+}
+
+// UnlockContext will unlock the mutex, if the mutex isn't held
+// ErrLockNotHeld will be returned
+func (m *Mutex) UnlockContext(ctx context.Context) error {
+	m.mu.Lock()
+	token, stopper, stopped := m.token, m.stopper, m.stopped
+	m.token, m.stopper, m.stopped, m.lost = "", nil, nil, nil
+	m.mu.Unlock()
+	if stopper == nil {
+		return ErrLockNotHeld
+	}
+	close(stopper)
+	<-stopped
+	if _, err := m.do(ctx, http.MethodDelete, &lockRequest{Token: token}, true); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Mutex) Lock() {
+	tRetry := time.NewTicker(m.config.RetryInterval)
+	defer tRetry.Stop()
+	for {
+		err := m.LockContext(context.Background())
+		if err == nil {
+			return
+		}
+		m.errorHandler(err)
+		<-tRetry.C
+	}
+}
+
+func (m *Mutex) Unlock() {
+	err := m.UnlockContext(context.Background())
+	if errors.Is(err, ErrLockNotHeld) {
+		panic("attempted to unlock an unlocked mutex")
+	}
+	if err != nil {
+		m.errorHandler(err)
+	}
+}
+
+// Close will stop renewing the mutex (if locked), the lock will expire
+// once its time to live has passed
+func (m *Mutex) Close() error {
+	m.mu.Lock()
+	stopper, stopped := m.stopper, m.stopped
+	m.token, m.stopper, m.stopped, m.lost = "", nil, nil, nil
+	m.mu.Unlock()
+	if stopper != nil {
+		close(stopper)
+		<-stopped
+	}
+	return nil
+}
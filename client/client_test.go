@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMutexAcquireNotRetried(t *testing.T) {
+	var acquires atomic.Int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acquires.Add(1)
+		// drop the connection as if the response was lost
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+	mu := NewMutex(Configuration{Address: server.URL, Name: "employee", RetryInterval: time.Millisecond})
+	defer mu.Close()
+	if err := mu.LockContext(t.Context()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := acquires.Load(); n != 1 {
+		t.Fatalf("expected a single acquire, got %d", n)
+	}
+}
+
+func TestMutexRetryInterval(t *testing.T) {
+	mu := NewMutex(Configuration{RetryInterval: 100 * time.Millisecond, MaxRetryInterval: time.Second})
+	for _, test := range []struct {
+		retry    int
+		interval time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{100, time.Second},
+	} {
+		if interval := mu.retryInterval(test.retry); interval != test.interval {
+			t.Errorf("retry %d: expected %s, got %s", test.retry, test.interval, interval)
+		}
+	}
+}
+
+func TestMutexLost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodPost:
+			_ = json.NewEncoder(w).Encode(&lockResponse{Name: "employee", Token: "token"})
+		default:
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(&errorResponse{Error: "lock not held"})
+		}
+	}))
+	defer server.Close()
+	mu := NewMutex(Configuration{Address: server.URL, Name: "employee",
+		TTL: time.Second, RenewInterval: 10 * time.Millisecond})
+	defer mu.Close()
+	mu.errorHandler = func(error) {}
+	if mu.Lost() != nil {
+		t.Fatal("expected no lost channel while unlocked")
+	}
+	if err := mu.LockContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-mu.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lock to be lost")
+	}
+}
@@ -0,0 +1,388 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FaultStall  string = "stall"
+	FaultSever  string = "sever"
+	FaultDelete string = "delete"
+)
+
+const usageChaos string = `usage: chaos [flags]
+
+faults:
+ stall     the lock holder stalls (mid critical section) longer than the mutex expiration
+ sever     the connection used by the mutex is severed (using a local tcp proxy)
+ delete    the lock is deleted (force released) out from under the lock holder
+
+flags:
+`
+
+// ChaosResult describes the outcome of injecting a fault, the recovery
+// time is the time between the fault being injected and the first
+// consistent mutation that started after both the mutation that injected
+// the fault completed (e.g., the stalled holder wrote) and the last
+// inconsistent mutation
+type ChaosResult struct {
+	Fault           string        `json:"fault"`
+	Backend         string        `json:"backend"`
+	Mutations       int           `json:"mutations"`
+	Errors          int           `json:"errors"`
+	Inconsistencies int           `json:"inconsistencies"`
+	Panics          int           `json:"panics"`
+	Recovered       bool          `json:"recovered"`
+	RecoveryTime    time.Duration `json:"recovery_time_ns"`
+}
+
+// chaosScenario mutates the employee using a mutex (like mutexScenario)
+// but the first go routine will inject a fault while holding the mutex
+type chaosScenario struct {
+	sync.Mutex
+	fault         string
+	faultDuration time.Duration
+	injectAfter   time.Duration
+	config        Configuration
+	repository    EmployeeRepository
+	employee      *Employee
+	mutex         interface {
+		Mutex
+		Close() error
+	}
+	proxy  *tcpProxy
+	locker interface {
+		LockAdmin
+		Close() error
+	}
+	tSetup        time.Time
+	tInjected     time.Time
+	tHolderDone   time.Time
+	tInconsistent time.Time
+	injected      bool
+	holderDone    bool
+	recovered     bool
+	recovery      time.Duration
+	panics        int
+}
+
+func (s *chaosScenario) Name() string { return "chaos-" + s.fault }
+
+func (s *chaosScenario) UsesMutex() bool { return true }
+
+func (s *chaosScenario) Description() string {
+	return fmt.Sprintf("Concurrent Mutate with Mutex (%s fault)", s.fault)
+}
+
+// proxyTarget will start a proxy for the connection used by the mutex
+// and point the configuration at the proxy
+func (s *chaosScenario) proxyTarget() error {
+	var target string
+
+	switch s.config.MutexType {
+	default:
+		return errors.Errorf("sever unsupported for mutex type: %q", s.config.MutexType)
+	case "redis", "redis_redshift":
+		if s.config.RedisMode != "" && s.config.RedisMode != RedisModeStandalone {
+			return errors.Errorf("sever unsupported for redis mode: %q", s.config.RedisMode)
+		}
+		target = net.JoinHostPort(s.config.RedisHost, s.config.RedisPort)
+	case "remote":
+		u, err := url.Parse(s.config.RemoteAddress)
+		if err != nil {
+			return err
+		}
+		if target = u.Host; u.Port() == "" {
+			return errors.Errorf("remote address must include a port: %q", s.config.RemoteAddress)
+		}
+	}
+	proxy, err := newTCPProxy(target)
+	if err != nil {
+		return err
+	}
+	host, port, _ := net.SplitHostPort(proxy.Address())
+	switch s.config.MutexType {
+	case "redis", "redis_redshift":
+		if s.config.RedisTLSServerName == "" {
+			s.config.RedisTLSServerName = s.config.RedisHost
+		}
+		s.config.RedisHost, s.config.RedisPort = host, port
+	case "remote":
+		u, _ := url.Parse(s.config.RemoteAddress)
+		u.Host = proxy.Address()
+		s.config.RemoteAddress = u.String()
+	}
+	s.proxy = proxy
+	return nil
+}
+
+func (s *chaosScenario) Setup(env *ScenarioEnvironment) error {
+	s.config = *env.Config
+	s.repository, s.employee = env.Repository, env.Employee
+	switch s.fault {
+	case FaultSever:
+		if err := s.proxyTarget(); err != nil {
+			return err
+		}
+	case FaultDelete:
+		locker, err := newLocker(&s.config)
+		if err != nil {
+			return errors.Wrapf(err, "delete unsupported for mutex type %q", s.config.MutexType)
+		}
+		s.locker = locker
+	}
+	mutex, err := newMutex(&s.config)
+	if err != nil {
+		if s.proxy != nil {
+			s.proxy.Close()
+		}
+		if s.locker != nil {
+			s.locker.Close()
+		}
+		return err
+	}
+	s.mutex = mutex
+	s.tSetup = time.Now()
+	return nil
+}
+
+// shouldInject returns true if the go routine should inject the fault
+func (s *chaosScenario) shouldInject(goRoutine int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return goRoutine == 0 && !s.injected && time.Since(s.tSetup) >= s.injectAfter
+}
+
+// inject will inject the fault, it's executed while holding the mutex
+func (s *chaosScenario) inject() error {
+	s.Lock()
+	s.injected, s.tInjected = true, time.Now()
+	s.Unlock()
+	switch s.fault {
+	default:
+		return errors.Errorf("unsupported fault: %q", s.fault)
+	case FaultStall:
+		time.Sleep(s.config.MutexExpiration + s.faultDuration)
+	case FaultSever:
+		s.proxy.Sever()
+		time.AfterFunc(s.faultDuration, s.proxy.Restore)
+	case FaultDelete:
+		ctx, cancel := context.WithTimeout(context.Background(), s.faultDuration)
+		defer cancel()
+		return s.locker.ForceRelease(ctx, s.config.MutexName)
+	}
+	return nil
+}
+
+func (s *chaosScenario) Mutate(ctx context.Context, goRoutine int) (employeeRead *Employee, employeeUpdated *Employee, err error) {
+	tStart := time.Now()
+	inject := s.shouldInject(goRoutine)
+	// until the mutation that injected the fault completes, the fault
+	// isn't over (e.g., the stalled holder has yet to write) and any
+	// inconsistency resets the recovery
+	defer func() {
+		r := recover()
+		s.Lock()
+		defer s.Unlock()
+		if inject {
+			s.holderDone, s.tHolderDone = true, time.Now()
+		}
+		if r != nil {
+			s.panics++
+			employeeRead, employeeUpdated = nil, nil
+			err = errors.Errorf("panic: %v", r)
+			return
+		}
+		if err != nil || !s.injected {
+			return
+		}
+		if !versionConsistent(employeeRead, employeeUpdated) {
+			s.recovered, s.tInconsistent = false, time.Now()
+			return
+		}
+		if !s.recovered && s.holderDone && tStart.After(s.tHolderDone) && tStart.After(s.tInconsistent) {
+			s.recovered, s.recovery = true, time.Since(s.tInjected)
+		}
+	}()
+	unlock := lockMutex(s.mutex)
+	defer unlock()
+
+	if employeeRead, err = s.repository.ReadEmployee(ctx, s.employee.EmailAddress); err != nil {
+		return nil, nil, err
+	}
+	if inject {
+		if err := s.inject(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if employeeUpdated, err = s.repository.UpdateEmployee(ctx, s.employee); err != nil {
+		return nil, nil, err
+	}
+	return employeeRead, employeeUpdated, nil
+}
+
+func (s *chaosScenario) Consistent(employeeRead, employeeUpdated *Employee) bool {
+	return versionConsistent(employeeRead, employeeUpdated)
+}
+
+func (s *chaosScenario) Teardown() error {
+	err := s.mutex.Close()
+	if s.locker != nil {
+		if e := s.locker.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.proxy != nil {
+		if e := s.proxy.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// printChaosResults will print the chaos results as a table or json
+func printChaosResults(output string, results []*ChaosResult) error {
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case OutputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", " ")
+		return encoder.Encode(results)
+	case OutputText:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FAULT\tMUTEX TYPE\tMUTATIONS\tERRORS\tINCONSISTENCIES\tPANICS\tRECOVERY")
+		for _, result := range results {
+			recovery := "-"
+			if result.Recovered {
+				recovery = result.RecoveryTime.Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", result.Fault, result.Backend,
+				result.Mutations, result.Errors, result.Inconsistencies, result.Panics, recovery)
+		}
+		return w.Flush()
+	}
+}
+
+func mainChaos(config *Configuration, args []string, chOsSignal chan os.Signal) error {
+	var faultList, mutexTypeList, output string
+	var faultDuration, injectAfter time.Duration
+
+	employee := newEmployee()
+	flagSet := flag.NewFlagSet("chaos", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprint(flagSet.Output(), usageChaos)
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&faultList, "fault", strings.Join([]string{FaultStall, FaultSever, FaultDelete}, ","), "comma separated list of faults to inject")
+	flagSet.StringVar(&mutexTypeList, "mutex-type", config.MutexType, "comma separated list of mutex types (redis, redis_redshift or remote)")
+	flagSet.StringVar(&output, "output", OutputText, "the format of the results (text or json)")
+	flagSet.IntVar(&config.GoRoutines, "goroutines", config.GoRoutines, "the number of go routines mutating concurrently")
+	flagSet.DurationVar(&config.MutateInterval, "interval", config.MutateInterval, "how often each go routine mutates")
+	flagSet.DurationVar(&config.MutexExpiration, "expiration", config.MutexExpiration, "the mutex expiration")
+	flagSet.DurationVar(&injectAfter, "inject-after", 2*time.Second, "how long to wait before injecting the fault")
+	flagSet.DurationVar(&faultDuration, "fault-duration", 2*time.Second, "how long a fault lasts (how long the connection is severed or how much longer than the expiration the holder stalls)")
+	flagSet.DurationVar(&config.DemoDuration, "duration", 0, "how long each fault runs (default: long enough to inject and recover from the fault)")
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case OutputText, OutputJSON:
+	}
+	var faults, mutexTypes []string
+	for _, fault := range strings.Split(faultList, ",") {
+		switch fault = strings.TrimSpace(fault); fault {
+		default:
+			return errors.Errorf("unsupported fault: %q", fault)
+		case FaultStall, FaultSever, FaultDelete:
+			faults = append(faults, fault)
+		}
+	}
+	for _, mutexType := range strings.Split(mutexTypeList, ",") {
+		mutexTypes = append(mutexTypes, strings.TrimSpace(mutexType))
+	}
+	if config.GoRoutines < 2 {
+		return errors.New("goroutines must be at least 2")
+	}
+	if config.MutateInterval <= 0 || config.MutexExpiration <= 0 || faultDuration <= 0 || injectAfter < 0 {
+		return errors.New("interval, expiration and fault-duration must be positive")
+	}
+	minimumDuration := injectAfter + config.MutexExpiration + faultDuration
+	if config.DemoDuration == 0 {
+		config.DemoDuration = minimumDuration + injectAfter
+	}
+	if config.DemoDuration <= minimumDuration {
+		return errors.Errorf("duration must be longer than inject-after + expiration + fault-duration (%s)", minimumDuration)
+	}
+	verbose := output == OutputText
+	repository, err := newRepository(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := repository.Close(); err != nil {
+			fmt.Printf("error occured while closing the database: \"%s\"\n", err)
+		}
+	}()
+	var results []*ChaosResult
+chaos:
+	for _, mutexType := range mutexTypes {
+		for _, fault := range faults {
+			c := *config
+			c.MutexType = mutexType
+			if err := repository.DeleteEmployee(context.Background(), employee.EmailAddress); err != nil {
+				return err
+			}
+			employee, err := repository.CreateEmployee(context.Background(), employee)
+			if err != nil {
+				return err
+			}
+			scenario := &chaosScenario{
+				fault:         fault,
+				faultDuration: faultDuration,
+				injectAfter:   injectAfter,
+			}
+			env := &ScenarioEnvironment{Config: &c, Repository: repository, Employee: employee}
+			scenarioResults, err := runScenario(&c, chOsSignal, env, scenario, "demo",
+				runOptions{verbose: verbose})
+			if err != nil {
+				return err
+			}
+			results = append(results, &ChaosResult{
+				Fault:           fault,
+				Backend:         mutexType,
+				Mutations:       scenarioResults[0].Mutations,
+				Errors:          scenarioResults[0].Errors,
+				Inconsistencies: scenarioResults[0].Inconsistencies,
+				Panics:          scenario.panics,
+				Recovered:       scenario.recovered,
+				RecoveryTime:    scenario.recovery,
+			})
+			if scenarioResults[0].Interrupted {
+				break chaos
+			}
+		}
+	}
+	if verbose {
+		fmt.Println()
+	}
+	return printChaosResults(output, results)
+}
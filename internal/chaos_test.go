@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// expiredMutex is a mutex whose lock has always expired, it doesn't
+// exclude anything
+type expiredMutex struct{}
+
+func (expiredMutex) Lock()        {}
+func (expiredMutex) Unlock()      {}
+func (expiredMutex) Close() error { return nil }
+
+func TestChaosStallRecovery(t *testing.T) {
+	ctx := context.Background()
+	repository := NewMemoryRepository(0, time.Second)
+	employee, err := repository.CreateEmployee(ctx, newEmployee())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenario := &chaosScenario{
+		fault:         FaultStall,
+		faultDuration: 50 * time.Millisecond,
+		config:        Configuration{MutexExpiration: 50 * time.Millisecond},
+		repository:    repository,
+		employee:      employee,
+		mutex:         expiredMutex{},
+		tSetup:        time.Now(),
+	}
+	mutate := func(goRoutine int) bool {
+		employeeRead, employeeUpdated, err := scenario.Mutate(ctx, goRoutine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return scenario.Consistent(employeeRead, employeeUpdated)
+	}
+	recovered := func() bool {
+		scenario.Lock()
+		defer scenario.Unlock()
+		return scenario.recovered
+	}
+
+	// the holder stalls, the lock expires and another go routine mutates
+	// consistently before the holder writes; that isn't a recovery
+	holder := make(chan bool)
+	go func() { holder <- mutate(0) }()
+	time.Sleep(20 * time.Millisecond)
+	if !mutate(1) {
+		t.Fatal("expected the mutation during the stall to be consistent")
+	}
+	if recovered() {
+		t.Fatal("recovered before the stalled holder wrote")
+	}
+	if <-holder {
+		t.Fatal("expected the stalled holder's mutation to be inconsistent")
+	}
+	if recovered() {
+		t.Fatal("recovered after an inconsistent mutation")
+	}
+	if !mutate(1) {
+		t.Fatal("expected the mutation after the stall to be consistent")
+	}
+	if !recovered() {
+		t.Fatal("expected to recover after the stalled holder wrote")
+	}
+	if stall := scenario.config.MutexExpiration + scenario.faultDuration; scenario.recovery < stall {
+		t.Fatalf("expected the recovery (%s) to include the stall (%s)", scenario.recovery, stall)
+	}
+}
@@ -1,100 +1,446 @@
 package internal
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RedisModeStandalone string = "standalone"
+	RedisModeSentinel   string = "sentinel"
+	RedisModeCluster    string = "cluster"
+)
+
+const (
+	EmployeeStoreMysql  string = "mysql"
+	EmployeeStoreMemory string = "memory"
+	EmployeeStoreSqlite string = "sqlite"
+)
+
+const (
+	IsolationLevelDefault         string = ""
+	IsolationLevelReadUncommitted string = "read-uncommitted"
+	IsolationLevelReadCommitted   string = "read-committed"
+	IsolationLevelRepeatableRead  string = "repeatable-read"
+	IsolationLevelSerializable    string = "serializable"
 )
 
 // Configuration provides the different items we can use to
 // configure how we connect to the database
 type Configuration struct {
-	MysqlHost       string        `json:"mysql_host"`
-	MysqlPort       string        `json:"mysql_port"`
-	MysqlUsername   string        `json:"mysql_username"`
-	MysqlPassword   string        `json:"mysql_password"`
-	MysqlDatabase   string        `json:"mysql_database"`
-	MysqlParseTime  bool          `json:"mysql_parse_time"`
-	RedisHost       string        `json:"redis_host"`
-	RedisPort       string        `json:"redis_port"`
-	RedisUsername   string        `json:"redis_username"`
-	RedisPassword   string        `json:"redis_password"`
-	RedisDatabase   int           `json:"redis_database"`
-	RedisTimeout    time.Duration `json:"redis_timeout"`
-	MutexType       string        `json:"mutex_type"`
-	GoRoutines      int           `json:"go_routines"`
-	DemoDuration    time.Duration `json:"demo_duration"`
-	MutateInterval  time.Duration `json:"mutate_interval"`
-	RetryInterval   time.Duration `json:"retry_interval"`
-	MutexExpiration time.Duration `json:"mutex_expiration"`
+	MysqlHost             string        `json:"mysql_host"`
+	MysqlPort             string        `json:"mysql_port"`
+	MysqlUsername         string        `json:"mysql_username"`
+	MysqlPassword         string        `json:"mysql_password"`
+	MysqlDatabase         string        `json:"mysql_database"`
+	MysqlParseTime        bool          `json:"mysql_parse_time"`
+	MysqlUsernameFile     string        `json:"mysql_username_file"`
+	MysqlPasswordFile     string        `json:"mysql_password_file"`
+	MysqlTLS              bool          `json:"mysql_tls"`
+	MysqlTLSCAFile        string        `json:"mysql_tls_ca_file"`
+	MysqlTLSCertFile      string        `json:"mysql_tls_cert_file"`
+	MysqlTLSKeyFile       string        `json:"mysql_tls_key_file"`
+	MysqlTLSServerName    string        `json:"mysql_tls_server_name"`
+	MysqlTLSSkipVerify    bool          `json:"mysql_tls_skip_verify"`
+	RedisHost             string        `json:"redis_host"`
+	RedisPort             string        `json:"redis_port"`
+	RedisUsername         string        `json:"redis_username"`
+	RedisPassword         string        `json:"redis_password"`
+	RedisDatabase         int           `json:"redis_database"`
+	RedisTimeout          time.Duration `json:"redis_timeout"`
+	RedisUsernameFile     string        `json:"redis_username_file"`
+	RedisPasswordFile     string        `json:"redis_password_file"`
+	RedisTLS              bool          `json:"redis_tls"`
+	RedisTLSCAFile        string        `json:"redis_tls_ca_file"`
+	RedisTLSCertFile      string        `json:"redis_tls_cert_file"`
+	RedisTLSKeyFile       string        `json:"redis_tls_key_file"`
+	RedisTLSServerName    string        `json:"redis_tls_server_name"`
+	RedisTLSSkipVerify    bool          `json:"redis_tls_skip_verify"`
+	RedisMode             string        `json:"redis_mode"`
+	RedisMasterName       string        `json:"redis_master_name"`
+	RedisAddresses        []string      `json:"redis_addresses"`
+	RedisSentinelPassword string        `json:"redis_sentinel_password"`
+	EmployeeStore         string        `json:"employee_store"`
+	MemoryLatency         time.Duration `json:"memory_latency"`
+	SqliteFile            string        `json:"sqlite_file"`
+	SqliteBusyTimeout     time.Duration `json:"sqlite_busy_timeout"`
+	AutoMigrate           bool          `json:"auto_migrate"`
+	SqlTimeout            time.Duration `json:"sql_timeout"`
+	MysqlLockWaitTimeout  time.Duration `json:"mysql_lock_wait_timeout"`
+	IsolationLevel        string        `json:"isolation_level"`
+	TxRetries             int           `json:"tx_retries"`
+	TxBackoff             time.Duration `json:"tx_backoff"`
+	TxMaxBackoff          time.Duration `json:"tx_max_backoff"`
+	MutexType             string        `json:"mutex_type"`
+	MutexName             string        `json:"mutex_name"`
+	GoRoutines            int           `json:"go_routines"`
+	DemoDuration          time.Duration `json:"demo_duration"`
+	MutateInterval        time.Duration `json:"mutate_interval"`
+	RetryInterval         time.Duration `json:"retry_interval"`
+	MutexExpiration       time.Duration `json:"mutex_expiration"`
+	CasRetries            int           `json:"cas_retries"`
+	CasBackoff            time.Duration `json:"cas_backoff"`
+	CasMaxBackoff         time.Duration `json:"cas_max_backoff"`
+	HttpAddress           string        `json:"http_address"`
+	GrpcAddress           string        `json:"grpc_address"`
+	RemoteAddress         string        `json:"remote_address"`
+
+	// file is the configuration file (if any) the configuration was
+	// loaded from, it's passed along to child processes
+	file string
+}
+
+// NewConfiguration will return a configuration pointer with the
+// default configuration
+func NewConfiguration() *Configuration {
+	return &Configuration{
+		MysqlHost:         "localhost",
+		MysqlPort:         "3306",
+		MysqlUsername:     "root",
+		MysqlPassword:     "mysql",
+		MysqlDatabase:     "go_blog_distributed_mutex",
+		MysqlParseTime:    false,
+		RedisHost:         "localhost",
+		RedisPort:         "6379",
+		RedisUsername:     "go_blog_distributed_mutex",
+		RedisPassword:     "go_blog_distributed_mutex",
+		RedisMode:         RedisModeStandalone,
+		EmployeeStore:     EmployeeStoreMysql,
+		SqliteFile:        "go_blog_distributed_mutex.db",
+		SqliteBusyTimeout: 10 * time.Second,
+		AutoMigrate:       true,
+		SqlTimeout:        30 * time.Second,
+		TxRetries:         3,
+		TxBackoff:         5 * time.Millisecond,
+		TxMaxBackoff:      500 * time.Millisecond,
+		MutexType:         "redis",
+		MutexName:         "employee",
+		GoRoutines:        2,
+		DemoDuration:      10 * time.Second,
+		MutateInterval:    1000 * time.Millisecond,
+		RetryInterval:     time.Millisecond,
+		MutexExpiration:   10 * time.Second,
+		CasRetries:        10,
+		CasBackoff:        time.Millisecond,
+		CasMaxBackoff:     100 * time.Millisecond,
+		HttpAddress:       ":8080",
+		GrpcAddress:       ":8081",
+		RemoteAddress:     "http://localhost:8080",
+	}
+}
+
+// LoadConfiguration will load the configuration in layers, the defaults
+// are overridden by the configuration file (if any) and the configuration
+// file is overridden by the environment; flags are parsed on top of the
+// returned configuration
+func LoadConfiguration(file string, envs map[string]string) (*Configuration, error) {
+	c := NewConfiguration()
+	if file != "" {
+		if err := c.FromFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.FromEnv(envs); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // ConfigFromEnv can be used to generate a configuration pointer
 // from a list of environments, it'll set the default configuraton
 // as well
-func ConfigFromEnv(envs map[string]string) *Configuration {
-	c := &Configuration{
-		MysqlHost:       "localhost",
-		MysqlPort:       "3306",
-		MysqlUsername:   "root",
-		MysqlPassword:   "mysql",
-		MysqlDatabase:   "go_blog_distributed_mutex",
-		MysqlParseTime:  false,
-		RedisHost:       "localhost",
-		RedisPort:       "6379",
-		RedisUsername:   "go_blog_distributed_mutex",
-		RedisPassword:   "go_blog_distributed_mutex",
-		MutexType:       "redis",
-		GoRoutines:      2,
-		DemoDuration:    10 * time.Second,
-		MutateInterval:  1000 * time.Millisecond,
-		RetryInterval:   time.Millisecond,
-		MutexExpiration: 10 * time.Second,
-	}
-	if host, ok := envs["MYSQL_HOST"]; ok {
-		c.MysqlHost = host
-	}
-	if port, ok := envs["MYSQL_PORT"]; ok {
-		c.MysqlPort = port
-	}
-	if username, ok := envs["MYSQL_USERNAME"]; ok {
-		c.MysqlUsername = username
-	}
-	if password, ok := envs["MYSQL_PASSWORD"]; ok {
-		c.MysqlPassword = password
-	}
-	if database, ok := envs["MYSQL_DATABASE"]; ok {
-		c.MysqlDatabase = database
-	}
-	if redisAddress, ok := envs["REDIS_ADDRESS"]; ok {
-		c.RedisHost = redisAddress
-	}
-	if redisPort, ok := envs["REDIS_PORT"]; ok {
-		c.RedisPort = redisPort
-	}
-	if redisUsername, ok := envs["REDIS_USERNAME"]; ok {
-		c.RedisUsername = redisUsername
-	}
-	if redisPassword, ok := envs["REDIS_PASSWORD"]; ok {
-		c.RedisPassword = redisPassword
-	}
-	if redisDatabase, ok := envs["REDIS_DATABASE"]; ok {
-		i, _ := strconv.ParseInt(redisDatabase, 10, 64)
-		c.RedisDatabase = int(i)
-	}
-	if redisTimeout, ok := envs["REDIS_TIMEOUT"]; ok {
-		i, _ := strconv.ParseInt(redisTimeout, 10, 64)
-		c.RedisTimeout = time.Duration(i) * time.Second
-	}
-	if retryInterval, ok := envs["RETRY_INTERVAL"]; ok {
-		i, _ := strconv.ParseInt(retryInterval, 10, 64)
-		c.RetryInterval = time.Duration(i) * time.Millisecond
-	}
-	if mutexType, ok := envs["MUTEX_TYPE"]; ok {
-		c.MutexType = mutexType
-	}
-	if mutexExpiration, ok := envs["MUTEX_EXPIRATION"]; ok {
-		i, _ := strconv.ParseInt(mutexExpiration, 10, 64)
-		c.MutexExpiration = time.Duration(i) * time.Second
-	}
-	return c
+func ConfigFromEnv(envs map[string]string) (*Configuration, error) {
+	return LoadConfiguration("", envs)
+}
+
+// durationKeys returns the json keys of the fields that are durations
+func durationKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(Configuration{})
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if field.Type != reflect.TypeOf(time.Duration(0)) {
+			continue
+		}
+		keys[strings.Split(field.Tag.Get("json"), ",")[0]] = true
+	}
+	return keys
+}
+
+// FromFile will read the configuration from a json or yaml file (chosen by
+// the extension) using the json keys, only the keys present in the file are
+// set; durations can be a string (e.g., 10s) or a number of nanoseconds
+func (c *Configuration) FromFile(path string) error {
+	var values map[string]any
+
+	bytesFile, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to read configuration file")
+	}
+	switch extension := strings.ToLower(filepath.Ext(path)); extension {
+	default:
+		return errors.Errorf("unsupported configuration file extension: %q (json, yaml or yml)", extension)
+	case ".json":
+		err = json.Unmarshal(bytesFile, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(bytesFile, &values)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to parse configuration file %q", path)
+	}
+	durations := durationKeys()
+	for key, value := range values {
+		s, ok := value.(string)
+		if !ok || !durations[key] {
+			continue
+		}
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.Errorf("configuration file %q: %s: invalid duration %q", path, key, s)
+		}
+		values[key] = duration
+	}
+	bytesValues, err := json.Marshal(values)
+	if err != nil {
+		return errors.Wrapf(err, "unable to parse configuration file %q", path)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bytesValues))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return errors.Wrapf(err, "configuration file %q", path)
+	}
+	c.file = path
+	return nil
+}
+
+// envParser is used to parse the environment, problems are collected
+// such that they can all be reported at once
+type envParser struct {
+	envs     map[string]string
+	problems []string
+}
+
+func (p *envParser) string(name string, value *string) {
+	if s, ok := p.envs[name]; ok {
+		*value = s
+	}
+}
+
+func (p *envParser) bool(name string, value *bool) {
+	s, ok := p.envs[name]
+	if !ok {
+		return
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s: invalid boolean %q", name, s))
+		return
+	}
+	*value = b
+}
+
+func (p *envParser) int(name string, value *int) {
+	s, ok := p.envs[name]
+	if !ok {
+		return
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s: invalid integer %q", name, s))
+		return
+	}
+	*value = i
+}
+
+// duration will parse either an integer in the given unit (e.g., the
+// number of seconds) or a duration such as 10s
+func (p *envParser) duration(name string, unit time.Duration, value *time.Duration) {
+	s, ok := p.envs[name]
+	if !ok {
+		return
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*value = time.Duration(i) * unit
+		return
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s: invalid duration %q (an integer in %s or a duration such as 10s)",
+			name, s, strings.TrimPrefix(unit.String(), "1")))
+		return
+	}
+	*value = duration
+}
+
+func (p *envParser) list(name string, value *[]string) {
+	s, ok := p.envs[name]
+	if !ok {
+		return
+	}
+	*value = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*value = append(*value, item)
+		}
+	}
+}
+
+// FromEnv will set the configuration from the environment, only the
+// environment variables that are present are set; an error is returned
+// if any of them can't be parsed
+func (c *Configuration) FromEnv(envs map[string]string) error {
+	p := &envParser{envs: envs}
+	p.string("MYSQL_HOST", &c.MysqlHost)
+	p.string("MYSQL_PORT", &c.MysqlPort)
+	p.string("MYSQL_USERNAME", &c.MysqlUsername)
+	p.string("MYSQL_PASSWORD", &c.MysqlPassword)
+	p.string("MYSQL_DATABASE", &c.MysqlDatabase)
+	p.bool("MYSQL_PARSE_TIME", &c.MysqlParseTime)
+	p.string("MYSQL_USERNAME_FILE", &c.MysqlUsernameFile)
+	p.string("MYSQL_PASSWORD_FILE", &c.MysqlPasswordFile)
+	p.bool("MYSQL_TLS", &c.MysqlTLS)
+	p.string("MYSQL_TLS_CA_FILE", &c.MysqlTLSCAFile)
+	p.string("MYSQL_TLS_CERT_FILE", &c.MysqlTLSCertFile)
+	p.string("MYSQL_TLS_KEY_FILE", &c.MysqlTLSKeyFile)
+	p.string("MYSQL_TLS_SERVER_NAME", &c.MysqlTLSServerName)
+	p.bool("MYSQL_TLS_SKIP_VERIFY", &c.MysqlTLSSkipVerify)
+	// REDIS_ADDRESS is kept for backwards compatibility, REDIS_HOST
+	// takes precedence if both are set
+	p.string("REDIS_ADDRESS", &c.RedisHost)
+	p.string("REDIS_HOST", &c.RedisHost)
+	p.string("REDIS_PORT", &c.RedisPort)
+	p.string("REDIS_USERNAME", &c.RedisUsername)
+	p.string("REDIS_PASSWORD", &c.RedisPassword)
+	p.int("REDIS_DATABASE", &c.RedisDatabase)
+	p.duration("REDIS_TIMEOUT", time.Second, &c.RedisTimeout)
+	p.string("REDIS_USERNAME_FILE", &c.RedisUsernameFile)
+	p.string("REDIS_PASSWORD_FILE", &c.RedisPasswordFile)
+	p.bool("REDIS_TLS", &c.RedisTLS)
+	p.string("REDIS_TLS_CA_FILE", &c.RedisTLSCAFile)
+	p.string("REDIS_TLS_CERT_FILE", &c.RedisTLSCertFile)
+	p.string("REDIS_TLS_KEY_FILE", &c.RedisTLSKeyFile)
+	p.string("REDIS_TLS_SERVER_NAME", &c.RedisTLSServerName)
+	p.bool("REDIS_TLS_SKIP_VERIFY", &c.RedisTLSSkipVerify)
+	p.string("REDIS_MODE", &c.RedisMode)
+	p.string("REDIS_MASTER_NAME", &c.RedisMasterName)
+	p.list("REDIS_ADDRESSES", &c.RedisAddresses)
+	p.string("REDIS_SENTINEL_PASSWORD", &c.RedisSentinelPassword)
+	p.string("EMPLOYEE_STORE", &c.EmployeeStore)
+	p.duration("MEMORY_LATENCY", time.Millisecond, &c.MemoryLatency)
+	p.string("SQLITE_FILE", &c.SqliteFile)
+	p.duration("SQLITE_BUSY_TIMEOUT", time.Millisecond, &c.SqliteBusyTimeout)
+	p.bool("AUTO_MIGRATE", &c.AutoMigrate)
+	p.duration("SQL_TIMEOUT", time.Second, &c.SqlTimeout)
+	p.duration("MYSQL_LOCK_WAIT_TIMEOUT", time.Second, &c.MysqlLockWaitTimeout)
+	p.string("ISOLATION_LEVEL", &c.IsolationLevel)
+	p.int("TX_RETRIES", &c.TxRetries)
+	p.duration("TX_BACKOFF", time.Millisecond, &c.TxBackoff)
+	p.duration("TX_MAX_BACKOFF", time.Millisecond, &c.TxMaxBackoff)
+	p.string("MUTEX_TYPE", &c.MutexType)
+	p.string("MUTEX_NAME", &c.MutexName)
+	p.int("GO_ROUTINES", &c.GoRoutines)
+	p.duration("DEMO_DURATION", time.Second, &c.DemoDuration)
+	p.duration("MUTATE_INTERVAL", time.Millisecond, &c.MutateInterval)
+	p.duration("RETRY_INTERVAL", time.Millisecond, &c.RetryInterval)
+	p.duration("MUTEX_EXPIRATION", time.Second, &c.MutexExpiration)
+	p.int("CAS_RETRIES", &c.CasRetries)
+	p.duration("CAS_BACKOFF", time.Millisecond, &c.CasBackoff)
+	p.duration("CAS_MAX_BACKOFF", time.Millisecond, &c.CasMaxBackoff)
+	p.string("HTTP_ADDRESS", &c.HttpAddress)
+	p.string("GRPC_ADDRESS", &c.GrpcAddress)
+	p.string("REMOTE_ADDRESS", &c.RemoteAddress)
+	if len(p.problems) > 0 {
+		return errors.Errorf("invalid environment: %s", strings.Join(p.problems, "; "))
+	}
+	return nil
+}
+
+// Validate will check the configuration, all of the problems found are
+// described in the returned error
+func (c *Configuration) Validate() error {
+	var problems []string
+
+	switch c.MutexType {
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported mutex type %q (redis, redis_redshift or remote)", c.MutexType))
+	case "redis", "redis_redshift", "remote":
+	}
+	switch c.EmployeeStore {
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported employee store %q (mysql, memory or sqlite)", c.EmployeeStore))
+	case EmployeeStoreMysql, EmployeeStoreMemory:
+	case EmployeeStoreSqlite:
+		if c.SqliteFile == "" {
+			problems = append(problems, "sqlite file is required for the sqlite employee store")
+		}
+	}
+	if _, err := txOptions(c.IsolationLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	switch c.RedisMode {
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported redis mode %q (standalone, sentinel or cluster)", c.RedisMode))
+	case RedisModeStandalone, RedisModeSentinel, RedisModeCluster:
+	}
+	if c.GoRoutines <= 0 {
+		problems = append(problems, fmt.Sprintf("go routines must be positive, got %d", c.GoRoutines))
+	}
+	if c.RedisDatabase < 0 {
+		problems = append(problems, fmt.Sprintf("redis database can't be negative, got %d", c.RedisDatabase))
+	}
+	if c.TxRetries < 0 {
+		problems = append(problems, fmt.Sprintf("tx retries can't be negative, got %d", c.TxRetries))
+	}
+	if c.CasRetries < 0 {
+		problems = append(problems, fmt.Sprintf("cas retries can't be negative, got %d", c.CasRetries))
+	}
+	for _, d := range []struct {
+		name     string
+		value    time.Duration
+		positive bool
+	}{
+		{"demo duration", c.DemoDuration, true},
+		{"mutate interval", c.MutateInterval, true},
+		{"retry interval", c.RetryInterval, true},
+		{"mutex expiration", c.MutexExpiration, true},
+		{"redis timeout", c.RedisTimeout, false},
+		{"memory latency", c.MemoryLatency, false},
+		{"sqlite busy timeout", c.SqliteBusyTimeout, false},
+		{"sql timeout", c.SqlTimeout, false},
+		{"mysql lock wait timeout", c.MysqlLockWaitTimeout, false},
+		{"tx backoff", c.TxBackoff, false},
+		{"tx max backoff", c.TxMaxBackoff, false},
+		{"cas backoff", c.CasBackoff, false},
+		{"cas max backoff", c.CasMaxBackoff, false},
+	} {
+		switch {
+		case d.positive && d.value <= 0:
+			problems = append(problems, fmt.Sprintf("%s must be positive, got %s", d.name, d.value))
+		case d.value < 0:
+			problems = append(problems, fmt.Sprintf("%s can't be negative, got %s", d.name, d.value))
+		}
+	}
+	if c.MysqlLockWaitTimeout%time.Second != 0 {
+		problems = append(problems, fmt.Sprintf("mysql lock wait timeout must be a whole number of seconds, got %s", c.MysqlLockWaitTimeout))
+	}
+	if c.TxMaxBackoff < c.TxBackoff {
+		problems = append(problems, fmt.Sprintf("tx max backoff (%s) can't be less than tx backoff (%s)", c.TxMaxBackoff, c.TxBackoff))
+	}
+	if c.CasMaxBackoff < c.CasBackoff {
+		problems = append(problems, fmt.Sprintf("cas max backoff (%s) can't be less than cas backoff (%s)", c.CasMaxBackoff, c.CasBackoff))
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
 }
@@ -0,0 +1,333 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	childReady       string = "ready"
+	childStart       string = "start"
+	childResultsLine string = "results"
+)
+
+// childHistograms contains the histograms of a single go routine, they're
+// sent to the coordinator so percentiles can be aggregated across processes
+type childHistograms struct {
+	Latency         *Histogram `json:"latency"`
+	LockWait        *Histogram `json:"lock_wait"`
+	CriticalSection *Histogram `json:"critical_section"`
+}
+
+// childResult is the result as written by a child process, the histories
+// are only included if the history is recorded
+type childResult struct {
+	*Result
+	Histograms []childHistograms `json:"histograms"`
+	Histories  []History         `json:"histories,omitempty"`
+}
+
+// childProcess describes a child process started by the coordinator
+type childProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// writeChildResults will write the results (including histograms) such
+// that they can be read by the coordinator, the results are preceded by
+// a line with the results message so any other output can be ignored
+func writeChildResults(w io.Writer, results []*Result) error {
+	var childResults []childResult
+
+	for _, result := range results {
+		childResult := childResult{Result: result}
+		for _, g := range result.GoRoutineResults {
+			childResult.Histograms = append(childResult.Histograms, childHistograms{
+				Latency:         &g.latency,
+				LockWait:        &g.lockWait,
+				CriticalSection: &g.criticalSection,
+			})
+			if result.Linearizability != nil {
+				childResult.Histories = append(childResult.Histories, g.history)
+			}
+		}
+		childResults = append(childResults, childResult)
+	}
+	if _, err := fmt.Fprintln(w, childResultsLine); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(childResults)
+}
+
+// childBarrier returns a function that will notify the coordinator that the
+// child is ready and then block until the coordinator starts all children
+func childBarrier(chOsSignal chan os.Signal) func() error {
+	return func() error {
+		chStart := make(chan error, 1)
+		fmt.Println(childReady)
+		go func() {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil {
+				chStart <- err
+				return
+			}
+			if strings.TrimSpace(line) != childStart {
+				chStart <- errors.Errorf("unexpected message from coordinator: %q", line)
+				return
+			}
+			chStart <- nil
+		}()
+		select {
+		case err := <-chStart:
+			return err
+		case <-chOsSignal:
+			return errors.New("interrupted while waiting for the coordinator")
+		}
+	}
+}
+
+// startChild will start a child process (the same binary) with the given
+// arguments, the child inherits the environment
+func startChild(args []string) (*childProcess, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &childProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}, nil
+}
+
+// waitReady will block until the child is ready, any output before the
+// ready message is ignored
+func (c *childProcess) waitReady() error {
+	for {
+		line, err := c.stdout.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "child exited before it was ready")
+		}
+		if strings.TrimSpace(line) == childReady {
+			return nil
+		}
+	}
+}
+
+// readResults will read the results of the child once it has exited, any
+// output preceding the results message is ignored
+func (c *childProcess) readResults() ([]childResult, error) {
+	var childResults []childResult
+	var errResults error
+
+	errResults = errors.New("child didn't write any results")
+	for {
+		line, err := c.stdout.ReadString('\n')
+		if strings.TrimSpace(line) == childResultsLine {
+			errResults = json.NewDecoder(c.stdout).Decode(&childResults)
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	// the output is drained such that the child can exit
+	if _, err := io.Copy(io.Discard, c.stdout); err != nil {
+		return nil, err
+	}
+	if err := c.cmd.Wait(); err != nil {
+		return nil, errors.Wrap(err, "child failed")
+	}
+	if errResults != nil {
+		return nil, errResults
+	}
+	return childResults, nil
+}
+
+// interrupt will interrupt the child such that it stops running and
+// writes the results it has so far, the child is killed if it can't be
+// interrupted
+func (c *childProcess) interrupt() {
+	if err := c.cmd.Process.Signal(os.Interrupt); err != nil {
+		_ = c.cmd.Process.Kill()
+	}
+}
+
+// kill will kill the child, it's used to clean up if another child fails
+func (c *childProcess) kill() {
+	if c.cmd.ProcessState != nil {
+		return
+	}
+	_ = c.cmd.Process.Kill()
+	_ = c.cmd.Wait()
+}
+
+// mergeChild will merge the result of a child process into the result, the
+// wall time is the longest run of the children (each child measures its run
+// from the barrier to its last mutation) so the time to start the processes,
+// tear them down and read their results isn't included
+func (r *Result) mergeChild(process int, childResult childResult, history bool) error {
+	if len(childResult.Histograms) != len(childResult.GoRoutineResults) {
+		return errors.New("histograms missing")
+	}
+	if history && len(childResult.Histories) != len(childResult.GoRoutineResults) {
+		return errors.New("histories missing")
+	}
+	r.Load, r.Rate = childResult.Load, r.Rate+childResult.Rate
+	r.Scheduled += childResult.Scheduled
+	r.Missed += childResult.Missed
+	r.Queued += childResult.Queued
+	r.Interrupted = r.Interrupted || childResult.Interrupted
+	r.WallTime = max(r.WallTime, childResult.WallTime)
+	for i, g := range childResult.GoRoutineResults {
+		g.Process = process
+		g.latency = *childResult.Histograms[i].Latency
+		g.lockWait = *childResult.Histograms[i].LockWait
+		g.criticalSection = *childResult.Histograms[i].CriticalSection
+		if history {
+			g.history = childResult.Histories[i]
+			for j := range g.history {
+				g.history[j].Process = process
+			}
+		}
+		r.GoRoutineResults = append(r.GoRoutineResults, g)
+	}
+	return nil
+}
+
+// coordinate will run the scenario in the given mode (demo or benchmark)
+// using the given number of child processes, the children are started at
+// the same time (once all of them are ready) and their results are
+// aggregated as if they were a single run
+func coordinate(config *Configuration, chOsSignal chan os.Signal, scenario Scenario,
+	mode string, processes int, employee *Employee, options runOptions) (*Result, error) {
+	var children []*childProcess
+
+	args := []string{"run", "--child",
+		"--scenario", scenario.Name(),
+		"--mode", mode,
+		"--output", OutputJSON,
+		"--mutex-type", config.MutexType,
+		"--isolation-level", config.IsolationLevel,
+		"--goroutines", strconv.Itoa(config.GoRoutines),
+		"--duration", config.DemoDuration.String(),
+		"--interval", config.MutateInterval.String(),
+		"--email-address", employee.EmailAddress,
+		"--first-name", employee.FirstName,
+		"--last-name", employee.LastName,
+	}
+	if config.file != "" {
+		args = append(args, "--config", config.file)
+	}
+	if options.history {
+		args = append(args, "--history")
+	}
+	if options.load == LoadOpen {
+		// the rate is divided evenly across the processes
+		rate := options.rate / float64(processes)
+		if _, err := rateInterval(rate); err != nil {
+			return nil, errors.Wrapf(err, "the rate per process (%d processes)", processes)
+		}
+		args = append(args, "--load", LoadOpen,
+			"--rate", strconv.FormatFloat(rate, 'f', -1, 64),
+			"--queue-size", strconv.Itoa(options.queueSize))
+	}
+	defer func() {
+		for _, child := range children {
+			child.kill()
+		}
+	}()
+	for range processes {
+		child, err := startChild(args)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	// the children are interrupted if the coordinator is interrupted while
+	// waiting for them, interrupted children stop waiting for the barrier
+	// or stop running and write their results
+	var signaled atomic.Bool
+	stopper := make(chan struct{})
+	defer close(stopper)
+	go func() {
+		select {
+		case <-stopper:
+		case <-chOsSignal:
+			signaled.Store(true)
+			for _, child := range children {
+				child.interrupt()
+			}
+		}
+	}()
+	for _, child := range children {
+		if err := child.waitReady(); err != nil {
+			return nil, err
+		}
+	}
+	for _, child := range children {
+		if _, err := fmt.Fprintln(child.stdin, childStart); err != nil {
+			return nil, err
+		}
+		if err := child.stdin.Close(); err != nil {
+			return nil, err
+		}
+	}
+	result := &Result{
+		Scenario:       scenario.Name(),
+		Mode:           mode,
+		Backend:        scenarioBackend(config, scenario),
+		IsolationLevel: config.IsolationLevel,
+		Load:           LoadClosed,
+		Processes:      processes,
+		GoRoutines:     processes * config.GoRoutines,
+		Interval:       config.MutateInterval,
+	}
+	for process, child := range children {
+		childResults, err := child.readResults()
+		if err != nil {
+			return nil, errors.Wrapf(err, "process [%d]", process)
+		}
+		for _, childResult := range childResults {
+			if err := result.mergeChild(process, childResult, options.history); err != nil {
+				return nil, errors.Wrapf(err, "process [%d]", process)
+			}
+		}
+	}
+	if result.Load == LoadOpen {
+		interval, err := rateInterval(result.Rate)
+		if err != nil {
+			return nil, err
+		}
+		result.Interval = interval
+	}
+	result.Interrupted = result.Interrupted || signaled.Load()
+	result.aggregate()
+	if options.history {
+		result.checkLinearizability()
+	}
+	return result, nil
+}
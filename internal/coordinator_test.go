@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shellChild starts a child process that runs the shell script
+func shellChild(t *testing.T, script string) *childProcess {
+	t.Helper()
+
+	cmd := exec.Command("sh", "-c", script)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return &childProcess{cmd: cmd, stdout: bufio.NewReader(stdout)}
+}
+
+func TestChildReadResults(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	buffer := &bytes.Buffer{}
+	if err := writeChildResults(buffer, []*Result{{Scenario: "no-mutex", Mode: "demo"}}); err != nil {
+		t.Fatal(err)
+	}
+	results := buffer.String()
+	for name, test := range map[string]struct {
+		script  string
+		results int
+		fail    bool
+	}{
+		"results":        {script: "printf '%s' RESULTS", results: 1},
+		"noise":          {script: "echo 'error occured: [{\"not\": \"results\"}]'; printf '%s' RESULTS", results: 1},
+		"trailing_noise": {script: "printf '%s' RESULTS; echo 'error occured while closing'", results: 1},
+		"no_results":     {script: "echo '[{}]'", fail: true},
+		"invalid":        {script: "echo results; echo '[{'", fail: true},
+		"child_failed":   {script: "printf '%s' RESULTS; exit 1", fail: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			script := strings.ReplaceAll(test.script, "RESULTS", shellQuote(results))
+			childResults, err := shellChild(t, script).readResults()
+			if test.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(childResults) != test.results || childResults[0].Scenario != "no-mutex" {
+				t.Fatalf("unexpected results: %+v", childResults)
+			}
+		})
+	}
+}
+
+// shellQuote will quote the string for the shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func TestResultMergeChild(t *testing.T) {
+	newChildResult := func(wallTime time.Duration, goRoutines int, interrupted bool) childResult {
+		result := childResult{Result: &Result{WallTime: wallTime, Interrupted: interrupted}}
+		for range goRoutines {
+			result.GoRoutineResults = append(result.GoRoutineResults, &GoRoutineResult{Mutations: 10})
+			result.Histograms = append(result.Histograms, childHistograms{
+				Latency:         &Histogram{},
+				LockWait:        &Histogram{},
+				CriticalSection: &Histogram{},
+			})
+		}
+		return result
+	}
+	for name, test := range map[string]struct {
+		children    []childResult
+		wallTime    time.Duration
+		goRoutines  int
+		interrupted bool
+		fail        bool
+	}{
+		"single": {children: []childResult{newChildResult(time.Second, 2, false)},
+			wallTime: time.Second, goRoutines: 2},
+		// the wall time is the longest child run, not the sum
+		"longest_child": {children: []childResult{newChildResult(2*time.Second, 1, false), newChildResult(3*time.Second, 2, false),
+			newChildResult(time.Second, 1, false)}, wallTime: 3 * time.Second, goRoutines: 4},
+		"interrupted": {children: []childResult{newChildResult(time.Second, 1, false), newChildResult(time.Second, 1, true)},
+			wallTime: time.Second, goRoutines: 2, interrupted: true},
+		"histograms_missing": {children: []childResult{{Result: &Result{
+			GoRoutineResults: []*GoRoutineResult{{}}}}}, fail: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			result := &Result{}
+			for process, childResult := range test.children {
+				if err := result.mergeChild(process, childResult, false); err != nil {
+					if !test.fail {
+						t.Fatal(err)
+					}
+					return
+				}
+			}
+			if test.fail {
+				t.Fatal("expected an error")
+			}
+			if result.WallTime != test.wallTime {
+				t.Fatalf("expected wall time %s, got %s", test.wallTime, result.WallTime)
+			}
+			if len(result.GoRoutineResults) != test.goRoutines {
+				t.Fatalf("expected %d go routine results, got %d", test.goRoutines, len(result.GoRoutineResults))
+			}
+			if last := result.GoRoutineResults[len(result.GoRoutineResults)-1]; last.Process != len(test.children)-1 {
+				t.Fatalf("expected process %d, got %d", len(test.children)-1, last.Process)
+			}
+			if result.Interrupted != test.interrupted {
+				t.Fatalf("expected interrupted %t, got %t", test.interrupted, result.Interrupted)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package internal
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"os"
 
 	"github.com/google/uuid"
 )
@@ -26,3 +28,13 @@ func RowsAffected(result sql.Result, errorString string) error {
 func GenerateID() string {
 	return uuid.Must(uuid.NewRandom()).String()
 }
+
+// GenerateOwner can be used to generate a string that identifies this
+// instance of the application (hostname and process id) as a lock owner
+func GenerateOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
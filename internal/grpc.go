@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	lockpb "github.com/antonio-alexander/go-blog-distributed-mutex/lockpb"
+
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	keepalive "google.golang.org/grpc/keepalive"
+	status "google.golang.org/grpc/status"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+)
+
+// maxMissedKeepAlives is the number of consecutive renewal intervals (a
+// third of the ttl) without a keep alive after which a held lock is
+// released, it's released before it would've expired
+const maxMissedKeepAlives int = 2
+
+// newGrpcServer will create a grpc server that pings idle connections such
+// that clients that disappear without closing their connection (e.g., a
+// network partition) are detected and their streams are closed
+func newGrpcServer() *grpc.Server {
+	return grpc.NewServer(
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    10 * time.Second,
+			Timeout: 5 * time.Second,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             5 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+}
+
+// stopGrpcServer will gracefully stop the server, if it doesn't stop within
+// the timeout (e.g., streams holding locks are still open), it's stopped
+// forcefully closing all connections
+func stopGrpcServer(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		server.GracefulStop()
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		server.Stop()
+		<-stopped
+	}
+}
+
+// GrpcLockServer exposes a Locker over grpc, in addition to acquire,
+// renew and release, it supports holding a lock for the lifetime of a
+// stream such that the lock is released if the client disappears
+type GrpcLockServer struct {
+	lockpb.UnimplementedLockServiceServer
+	config struct {
+		mutexExpiration time.Duration
+	}
+	locker interface {
+		Locker
+		LockAdmin
+	}
+}
+
+func NewGrpcLockServer(config *Configuration, locker interface {
+	Locker
+	LockAdmin
+}) *GrpcLockServer {
+	s := &GrpcLockServer{locker: locker}
+	s.config.mutexExpiration = config.MutexExpiration
+	return s
+}
+
+// Register will register the lock service with the given grpc server
+func (s *GrpcLockServer) Register(server *grpc.Server) {
+	lockpb.RegisterLockServiceServer(server, s)
+}
+
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrLockNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrLockNotHeld):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "timed out waiting for lock")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *GrpcLockServer) ttl(ttl *durationpb.Duration) (time.Duration, error) {
+	if ttl.AsDuration() <= 0 {
+		return s.config.mutexExpiration, nil
+	}
+	if ttl.AsDuration() < minLockTTL {
+		return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("ttl must be at least %s", minLockTTL))
+	}
+	return ttl.AsDuration(), nil
+}
+
+func (s *GrpcLockServer) acquire(ctx context.Context, request *lockpb.AcquireRequest) (*lockpb.Lease, error) {
+	if request.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	timeout := defaultLockTimeout
+	if request.GetTimeout().AsDuration() > 0 {
+		timeout = request.GetTimeout().AsDuration()
+	}
+	ttl, err := s.ttl(request.GetTtl())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	token, err := s.locker.Acquire(ctx, request.GetName(), request.GetOwner(), ttl)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &lockpb.Lease{
+		Name:  request.GetName(),
+		Owner: request.GetOwner(),
+		Token: token,
+		Ttl:   durationpb.New(ttl),
+	}, nil
+}
+
+func (s *GrpcLockServer) Acquire(ctx context.Context, request *lockpb.AcquireRequest) (*lockpb.Lease, error) {
+	return s.acquire(ctx, request)
+}
+
+func (s *GrpcLockServer) Renew(ctx context.Context, request *lockpb.RenewRequest) (*lockpb.Lease, error) {
+	ttl, err := s.ttl(request.GetTtl())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.locker.Renew(ctx, request.GetName(), request.GetToken(), ttl); err != nil {
+		return nil, grpcError(err)
+	}
+	return &lockpb.Lease{
+		Name:  request.GetName(),
+		Token: request.GetToken(),
+		Ttl:   durationpb.New(ttl),
+	}, nil
+}
+
+func (s *GrpcLockServer) Release(ctx context.Context, request *lockpb.ReleaseRequest) (*lockpb.ReleaseResponse, error) {
+	if err := s.locker.Release(ctx, request.GetName(), request.GetToken()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &lockpb.ReleaseResponse{}, nil
+}
+
+func (s *GrpcLockServer) Status(ctx context.Context, request *lockpb.StatusRequest) (*lockpb.LockStatus, error) {
+	lock, err := s.locker.Show(ctx, request.GetName())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &lockpb.LockStatus{
+		Name:    lock.Name,
+		Owner:   lock.Owner,
+		Ttl:     durationpb.New(lock.TTL),
+		Waiters: int32(lock.Waiters),
+	}, nil
+}
+
+// Hold will acquire the lock described by the first message of the
+// stream and will renew it whenever a keep alive is received until the
+// stream is closed, once closed, the lock is released; the client must
+// send a keep alive at least every third of the ttl, if keep alives are
+// missed (e.g., the client is partitioned but its connection is still
+// open) or the lock can't be renewed, the stream is closed
+func (s *GrpcLockServer) Hold(stream lockpb.LockService_HoldServer) error {
+	ctx := stream.Context()
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if request.GetAcquire() == nil {
+		return status.Error(codes.InvalidArgument, "first message must be acquire")
+	}
+	lease, err := s.acquire(ctx, request.GetAcquire())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.mutexExpiration)
+		defer cancel()
+		_ = s.locker.Release(ctx, lease.Name, lease.Token)
+	}()
+	if err := stream.Send(lease); err != nil {
+		return err
+	}
+	chKeepAlive, chErr := make(chan struct{}, 1), make(chan error, 1)
+	go func() {
+		for {
+			request, err := stream.Recv()
+			if err != nil {
+				chErr <- err
+				return
+			}
+			if request.GetKeepAlive() != nil {
+				select {
+				default:
+				case chKeepAlive <- struct{}{}:
+				}
+			}
+		}
+	}()
+	var missed int
+
+	ttl := lease.Ttl.AsDuration()
+	tCheck := time.NewTicker(ttl / 3)
+	defer tCheck.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-chErr:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-chKeepAlive:
+			missed = 0
+			if err := s.locker.Renew(ctx, lease.Name, lease.Token, ttl); err != nil {
+				return grpcError(err)
+			}
+			if err := stream.Send(lease); err != nil {
+				return err
+			}
+		case <-tCheck.C:
+			if missed++; missed >= maxMissedKeepAlives {
+				return status.Error(codes.DeadlineExceeded, "keep alive missed, the lock was released")
+			}
+		}
+	}
+}
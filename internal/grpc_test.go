@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	lockpb "github.com/antonio-alexander/go-blog-distributed-mutex/lockpb"
+
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	insecure "google.golang.org/grpc/credentials/insecure"
+	status "google.golang.org/grpc/status"
+	bufconn "google.golang.org/grpc/test/bufconn"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+)
+
+// testLocker is a locker that never blocks, acquiring a held lock fails
+type testLocker struct {
+	sync.Mutex
+	tokens map[string]string
+}
+
+func (l *testLocker) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.tokens[name]; ok {
+		return "", context.DeadlineExceeded
+	}
+	token := GenerateID()
+	l.tokens[name] = token
+	return token, nil
+}
+
+func (l *testLocker) Renew(ctx context.Context, name, token string, ttl time.Duration) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.tokens[name] != token {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+func (l *testLocker) Release(ctx context.Context, name, token string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.tokens[name] != token {
+		return ErrLockNotHeld
+	}
+	delete(l.tokens, name)
+	return nil
+}
+
+func (l *testLocker) held(name string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	_, ok := l.tokens[name]
+	return ok
+}
+
+func (l *testLocker) List(ctx context.Context) ([]*LockInfo, error) { return nil, nil }
+
+func (l *testLocker) Show(ctx context.Context, name string) (*LockInfo, error) {
+	return nil, ErrLockNotFound
+}
+
+func (l *testLocker) ForceRelease(ctx context.Context, name string) error { return nil }
+
+func (l *testLocker) SetTTL(ctx context.Context, name string, ttl time.Duration) error { return nil }
+
+func newTestGrpcClient(t *testing.T) (lockpb.LockServiceClient, *testLocker) {
+	t.Helper()
+
+	locker := &testLocker{tokens: make(map[string]string)}
+	listener := bufconn.Listen(1 << 20)
+	server := newGrpcServer()
+	NewGrpcLockServer(NewConfiguration(), locker).Register(server)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return lockpb.NewLockServiceClient(conn), locker
+}
+
+func TestGrpcLockServerTTL(t *testing.T) {
+	client, _ := newTestGrpcClient(t)
+	for _, ttl := range []time.Duration{time.Nanosecond, 2 * time.Nanosecond, minLockTTL - 1} {
+		_, err := client.Acquire(t.Context(), &lockpb.AcquireRequest{Name: "employee", Ttl: durationpb.New(ttl)})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ttl %s: expected invalid argument, got %v", ttl, err)
+		}
+	}
+	if _, err := client.Acquire(t.Context(), &lockpb.AcquireRequest{Name: "employee", Ttl: durationpb.New(minLockTTL)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrpcLockServerHold(t *testing.T) {
+	const ttl = 30 * time.Millisecond
+
+	for _, test := range []struct {
+		name      string
+		keepAlive bool
+	}{
+		{"keep_alive", true},
+		{"missed_keep_alive", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, locker := newTestGrpcClient(t)
+			stream, err := client.Hold(t.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Send(&lockpb.HoldRequest{Request: &lockpb.HoldRequest_Acquire{
+				Acquire: &lockpb.AcquireRequest{Name: "employee", Ttl: durationpb.New(ttl)},
+			}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := stream.Recv(); err != nil {
+				t.Fatal(err)
+			}
+			for tStop := time.Now().Add(5 * ttl); time.Now().Before(tStop); time.Sleep(ttl / 6) {
+				if !test.keepAlive {
+					continue
+				}
+				if err := stream.Send(&lockpb.HoldRequest{Request: &lockpb.HoldRequest_KeepAlive{
+					KeepAlive: &lockpb.KeepAlive{},
+				}}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := stream.Recv(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !test.keepAlive {
+				if _, err := stream.Recv(); status.Code(err) != codes.DeadlineExceeded {
+					t.Fatalf("expected deadline exceeded, got %v", err)
+				}
+				if locker.held("employee") {
+					t.Fatal("expected the lock to be released")
+				}
+				return
+			}
+			if !locker.held("employee") {
+				t.Fatal("expected the lock to be held")
+			}
+			if err := stream.CloseSend(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := stream.Recv(); err == nil {
+				t.Fatal("expected the stream to be closed")
+			}
+			if locker.held("employee") {
+				t.Fatal("expected the lock to be released")
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"encoding/json"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// histogramSubBucketBits determines the precision of the histogram, each
+// power of two is divided into 2^(bits-1) linear sub buckets so recorded
+// values are accurate to within 1/128 (~0.8%)
+const histogramSubBucketBits int = 8
+
+const (
+	histogramSubBucketCount int = 1 << histogramSubBucketBits
+	histogramSubBucketHalf  int = histogramSubBucketCount / 2
+)
+
+// Histogram is an HDR-style (log-linear) histogram of durations, it uses
+// a fixed amount of memory per power of two regardless of how many values
+// are recorded and can be merged without losing precision
+type Histogram struct {
+	counts []int64
+	count  int64
+	total  int64
+	min    int64
+	max    int64
+}
+
+// histogramIndex returns the index of the bucket the value falls into
+func histogramIndex(value int64) int {
+	if value < int64(histogramSubBucketCount) {
+		return int(value)
+	}
+	shift := bits.Len64(uint64(value)) - histogramSubBucketBits
+	subBucket := int(value >> shift)
+	return histogramSubBucketCount + (shift-1)*histogramSubBucketHalf + subBucket - histogramSubBucketHalf
+}
+
+// histogramValue returns the highest value that falls into the bucket
+func histogramValue(index int) int64 {
+	if index < histogramSubBucketCount {
+		return int64(index)
+	}
+	index -= histogramSubBucketCount
+	shift := index/histogramSubBucketHalf + 1
+	subBucket := int64(index%histogramSubBucketHalf + histogramSubBucketHalf)
+	return (subBucket+1)<<shift - 1
+}
+
+// Record will record a single duration, negative durations are recorded
+// as zero
+func (h *Histogram) Record(duration time.Duration) {
+	value := max(int64(duration), 0)
+	index := histogramIndex(value)
+	if index >= len(h.counts) {
+		h.counts = append(h.counts, make([]int64, index-len(h.counts)+1)...)
+	}
+	h.counts[index]++
+	if h.count == 0 || value < h.min {
+		h.min = value
+	}
+	if value > h.max {
+		h.max = value
+	}
+	h.count++
+	h.total += value
+}
+
+// Merge will add all of the values recorded by the given histogram
+func (h *Histogram) Merge(histogram *Histogram) {
+	if histogram.count == 0 {
+		return
+	}
+	if len(histogram.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]int64, len(histogram.counts)-len(h.counts))...)
+	}
+	for i, count := range histogram.counts {
+		h.counts[i] += count
+	}
+	if h.count == 0 || histogram.min < h.min {
+		h.min = histogram.min
+	}
+	if histogram.max > h.max {
+		h.max = histogram.max
+	}
+	h.count += histogram.count
+	h.total += histogram.total
+}
+
+// Count returns the number of recorded values
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+// Percentile returns the value at the given percentile (0-100), the value
+// is the highest value of the bucket it falls into but never exceeds the
+// maximum recorded value
+func (h *Histogram) Percentile(percentile float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(percentile / 100 * float64(h.count)))
+	target = min(max(target, 1), h.count)
+	var total int64
+	for index, count := range h.counts {
+		if total += count; total >= target {
+			return time.Duration(min(histogramValue(index), h.max))
+		}
+	}
+	return time.Duration(h.max)
+}
+
+// Stats returns a summary of the recorded values
+func (h *Histogram) Stats() LatencyStats {
+	if h.count == 0 {
+		return LatencyStats{}
+	}
+	return LatencyStats{
+		Count: h.count,
+		Min:   time.Duration(h.min),
+		Mean:  time.Duration(h.total / h.count),
+		P50:   h.Percentile(50),
+		P90:   h.Percentile(90),
+		P99:   h.Percentile(99),
+		P999:  h.Percentile(99.9),
+		Max:   time.Duration(h.max),
+	}
+}
+
+// histogramJSON is the json representation of a histogram, only the
+// buckets that contain values are included
+type histogramJSON struct {
+	Count   int64      `json:"count"`
+	Total   int64      `json:"total"`
+	Min     int64      `json:"min"`
+	Max     int64      `json:"max"`
+	Buckets [][2]int64 `json:"buckets"`
+}
+
+// MarshalJSON can be used to marshal the histogram such that it can be
+// merged by another process without losing precision
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	histogram := histogramJSON{
+		Count:   h.count,
+		Total:   h.total,
+		Min:     h.min,
+		Max:     h.max,
+		Buckets: [][2]int64{},
+	}
+	for index, count := range h.counts {
+		if count > 0 {
+			histogram.Buckets = append(histogram.Buckets, [2]int64{int64(index), count})
+		}
+	}
+	return json.Marshal(histogram)
+}
+
+// UnmarshalJSON can be used to unmarshal a histogram
+func (h *Histogram) UnmarshalJSON(bytes []byte) error {
+	var histogram histogramJSON
+
+	if err := json.Unmarshal(bytes, &histogram); err != nil {
+		return err
+	}
+	*h = Histogram{
+		count: histogram.Count,
+		total: histogram.Total,
+		min:   histogram.Min,
+		max:   histogram.Max,
+	}
+	for _, bucket := range histogram.Buckets {
+		index, count := int(bucket[0]), bucket[1]
+		if index < 0 || index > histogramIndex(math.MaxInt64) {
+			return errors.Errorf("histogram bucket out of range: %d", index)
+		}
+		if index >= len(h.counts) {
+			h.counts = append(h.counts, make([]int64, index-len(h.counts)+1)...)
+		}
+		h.counts[index] += count
+	}
+	return nil
+}
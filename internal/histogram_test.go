@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogramIndex(t *testing.T) {
+	for _, test := range []struct {
+		value int64
+		index int
+	}{
+		{0, 0},
+		{1, 1},
+		{255, 255},
+		{256, 256},
+		{257, 256},
+		{258, 257},
+		{511, 383},
+		{512, 384},
+		{1023, 511},
+		{1024, 512},
+	} {
+		if index := histogramIndex(test.value); index != test.index {
+			t.Errorf("value %d: expected index %d, got %d", test.value, test.index, index)
+		}
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	// every bucket's highest value maps to the bucket and the next value
+	// maps to the next bucket (the buckets are contiguous), the width of
+	// each bucket is within the precision of the histogram
+	last := histogramIndex(math.MaxInt64)
+	for index := 0; index < last; index++ {
+		value := histogramValue(index)
+		if i := histogramIndex(value); i != index {
+			t.Fatalf("bucket %d: highest value %d maps to bucket %d", index, value, i)
+		}
+		if i := histogramIndex(value + 1); i != index+1 {
+			t.Fatalf("bucket %d: value %d maps to bucket %d", index, value+1, i)
+		}
+		if index > 0 {
+			low := histogramValue(index-1) + 1
+			if width := value - low + 1; float64(width) > float64(low)/128+1 {
+				t.Fatalf("bucket %d: width %d exceeds the precision for %d", index, width, low)
+			}
+		}
+	}
+	if value := histogramValue(last); value != math.MaxInt64 {
+		t.Fatalf("expected the last bucket to end at %d, got %d", int64(math.MaxInt64), value)
+	}
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	h := &Histogram{}
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	h.Record(-time.Second)
+	for _, test := range []struct {
+		percentile float64
+		expected   time.Duration
+	}{
+		{0, 0},
+		{50, 500 * time.Microsecond},
+		{90, 900 * time.Microsecond},
+		{99, 990 * time.Microsecond},
+		{100, 1000 * time.Microsecond},
+	} {
+		value := h.Percentile(test.percentile)
+		if value < test.expected || float64(value-test.expected) > float64(test.expected)/128 {
+			t.Errorf("p%v: expected %s (within 1/128), got %s", test.percentile, test.expected, value)
+		}
+	}
+	stats := h.Stats()
+	if stats.Count != 1001 || stats.Min != 0 || stats.Max != time.Millisecond {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if (&Histogram{}).Stats() != (LatencyStats{}) {
+		t.Fatal("expected empty stats for an empty histogram")
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a, b, all := &Histogram{}, &Histogram{}, &Histogram{}
+	for i := 1; i <= 100; i++ {
+		value := time.Duration(i*i) * time.Microsecond
+		if i%2 == 0 {
+			a.Record(value)
+		} else {
+			b.Record(value)
+		}
+		all.Record(value)
+	}
+	merged := &Histogram{}
+	merged.Merge(a)
+	merged.Merge(&Histogram{})
+	merged.Merge(b)
+	if merged.Stats() != all.Stats() {
+		t.Fatalf("expected %+v, got %+v", all.Stats(), merged.Stats())
+	}
+}
+
+func TestHistogramJSON(t *testing.T) {
+	h := &Histogram{}
+	for _, value := range []time.Duration{time.Nanosecond, time.Microsecond, time.Millisecond, time.Second, time.Hour} {
+		h.Record(value)
+	}
+	bytes, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaled := &Histogram{}
+	if err := json.Unmarshal(bytes, unmarshaled); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshaled.Stats() != h.Stats() {
+		t.Fatalf("expected %+v, got %+v", h.Stats(), unmarshaled.Stats())
+	}
+	for _, bytes := range []string{`{"buckets":[[-1,1]]}`, `{"buckets":[[100000,1]]}`} {
+		if err := json.Unmarshal([]byte(bytes), &Histogram{}); err == nil {
+			t.Errorf("%s: expected an error", bytes)
+		}
+	}
+}
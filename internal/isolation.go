@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+const usageIsolation string = `usage: isolation [flags]
+
+Runs each scenario (as a benchmark) under each of the mysql transaction
+isolation levels and prints the inconsistencies and deadlocks for each.
+
+flags:
+`
+
+// printIsolationTable will print a comparison table of the results
+func printIsolationTable(w io.Writer, results []*Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ISOLATION LEVEL\tSCENARIO\tMUTATIONS\tERRORS\tDEADLOCKS\tRETRIES\tTX RETRIES\tINCONSISTENCIES\tTHROUGHPUT\tP99")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.3f/s\t%s\n",
+			result.IsolationLevel, result.Scenario, result.Mutations, result.Errors,
+			result.Deadlocks, result.Retries, result.TxRetries, result.Inconsistencies, result.Throughput, result.Latency.P99)
+	}
+	return tw.Flush()
+}
+
+func mainIsolation(config *Configuration, args []string, chOsSignal chan os.Signal) error {
+	var isolationLevelList, scenarioList, output, outputFile string
+
+	employee := newEmployee()
+	flagSet := flag.NewFlagSet("isolation", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprint(flagSet.Output(), usageIsolation)
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&isolationLevelList, "isolation-level", strings.Join([]string{IsolationLevelReadCommitted,
+		IsolationLevelRepeatableRead, IsolationLevelSerializable}, ","), "comma separated list of isolation levels")
+	flagSet.StringVar(&scenarioList, "scenario", "no-mutex,transaction,row-lock,version", "comma separated list of scenarios to run")
+	flagSet.IntVar(&config.GoRoutines, "goroutines", config.GoRoutines, "the number of go routines mutating concurrently")
+	flagSet.DurationVar(&config.DemoDuration, "duration", config.DemoDuration, "how long each combination runs")
+	flagSet.DurationVar(&config.MutateInterval, "interval", config.MutateInterval, "how often each go routine mutates")
+	flagSet.StringVar(&output, "output", OutputText, "the format of the results (text for a comparison table, json or csv)")
+	flagSet.StringVar(&outputFile, "output-file", "", "the file to write the results to (default: stdout)")
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case OutputText, OutputJSON, OutputCSV:
+	}
+	// sqlite transactions are always serializable and the memory store
+	// doesn't have isolation levels, so only mysql is compared
+	if config.EmployeeStore != EmployeeStoreMysql {
+		return errors.Errorf("isolation levels are only supported by the mysql employee store, got %q", config.EmployeeStore)
+	}
+	isolationLevels, err := parseList(isolationLevelList, func(s string) (string, error) {
+		_, err := txOptions(s)
+		return s, err
+	})
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	var scenarios []Scenario
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(scenarioList, ",") {
+		selected[strings.TrimSpace(name)] = true
+	}
+	for _, scenario := range Scenarios() {
+		if selected[scenario.Name()] {
+			scenarios = append(scenarios, scenario)
+			delete(selected, scenario.Name())
+		}
+	}
+	for name := range selected {
+		return errors.Errorf("unsupported scenario: %q", name)
+	}
+	verbose := output == OutputText || outputFile != ""
+	var results []*Result
+	for _, isolationLevel := range isolationLevels {
+		if interrupted(results) {
+			break
+		}
+		c := *config
+		c.IsolationLevel = isolationLevel
+		levelResults, err := runIsolationLevel(&c, chOsSignal, employee, scenarios, verbose)
+		if err != nil {
+			return err
+		}
+		results = append(results, levelResults...)
+	}
+	if output != OutputText {
+		return writeResultsFile(output, outputFile, results)
+	}
+	if outputFile == "" {
+		fmt.Println()
+		return printIsolationTable(os.Stdout, results)
+	}
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	if err := printIsolationTable(file, results); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// runIsolationLevel will run each scenario with a repository whose
+// transactions use the configured isolation level, the employee is
+// re-created such that each isolation level starts from the same state
+func runIsolationLevel(config *Configuration, chOsSignal chan os.Signal, employee *Employee,
+	scenarios []Scenario, verbose bool) ([]*Result, error) {
+	var results []*Result
+
+	repository, err := newRepository(config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := repository.Close(); err != nil {
+			fmt.Printf("error occured while closing the database: \"%s\"\n", err)
+		}
+	}()
+	if err := repository.DeleteEmployee(context.Background(), employee.EmailAddress); err != nil {
+		return nil, err
+	}
+	employeeCreated, err := repository.CreateEmployee(context.Background(), employee)
+	if err != nil {
+		return nil, err
+	}
+	env := &ScenarioEnvironment{Config: config, Repository: repository, Employee: employeeCreated}
+	for _, scenario := range scenarios {
+		if verbose {
+			fmt.Printf("running %s (isolation level: %s, go routines: %d)\n",
+				scenario.Name(), config.IsolationLevel, config.GoRoutines)
+		}
+		scenarioResults, err := runScenario(config, chOsSignal, env, scenario,
+			"benchmark", runOptions{load: LoadClosed})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, scenarioResults...)
+		if interrupted(results) {
+			break
+		}
+	}
+	return results, nil
+}
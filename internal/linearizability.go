@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+)
+
+const (
+	OperationRead  string = "read"
+	OperationWrite string = "write"
+)
+
+// Operation describes a single operation on the employee row, the row is
+// modeled as a register holding the version; a read observes the version
+// and a write replaces the version it read with the version it wrote
+// atomically. Each mutation is recorded as a single write (read-modify-write)
+// whose read is the version the scenario read
+type Operation struct {
+	GoRoutine int       `json:"go_routine"`
+	Process   int       `json:"process"`
+	Kind      string    `json:"kind"`
+	Read      int       `json:"read"`
+	Written   int       `json:"written,omitempty"`
+	Invoke    time.Time `json:"invoke"`
+	Complete  time.Time `json:"complete"`
+}
+
+// History is a list of completed operations
+type History []Operation
+
+// LinearizabilityResult describes the outcome of checking a history, if
+// the history isn't linearizable the violation is the minimal subsequence
+// of the history that isn't linearizable
+type LinearizabilityResult struct {
+	Linearizable bool    `json:"linearizable"`
+	Operations   int     `json:"operations"`
+	Violation    History `json:"violation,omitempty"`
+}
+
+// registerState is the state of the register model, the version is only
+// known once an operation has observed it
+type registerState struct {
+	known   bool
+	version int
+}
+
+// step will apply the operation to the register, it returns false if the
+// operation isn't legal in the given state
+func (s registerState) step(operation *Operation) (registerState, bool) {
+	switch operation.Kind {
+	default:
+		return s, false
+	case OperationRead:
+		if s.known && s.version != operation.Read {
+			return s, false
+		}
+		return registerState{known: true, version: operation.Read}, true
+	case OperationWrite:
+		if s.known && s.version != operation.Read {
+			return s, false
+		}
+		return registerState{known: true, version: operation.Written}, true
+	}
+}
+
+// record will record a mutation as a single read-modify-write operation,
+// the version read by the scenario is replaced by the version written; the
+// version read is what the scenario acted on so a lost update (two mutations
+// that replaced the same version) isn't linearizable
+func (h *History) record(goRoutine int, employeeRead, employeeUpdated *Employee, tInvoke, tComplete time.Time) {
+	*h = append(*h, Operation{
+		GoRoutine: goRoutine,
+		Kind:      OperationWrite,
+		Read:      employeeRead.Version,
+		Written:   employeeUpdated.Version,
+		Invoke:    tInvoke,
+		Complete:  tComplete,
+	})
+}
+
+// linearizabilityEntry is a call or return event in the history, entries
+// are kept in a doubly linked list so they can be lifted and unlifted
+type linearizabilityEntry struct {
+	operation  int
+	call       bool
+	match      *linearizabilityEntry
+	prev, next *linearizabilityEntry
+}
+
+func (e *linearizabilityEntry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	match := e.match
+	match.prev.next = match.next
+	if match.next != nil {
+		match.next.prev = match.prev
+	}
+}
+
+func (e *linearizabilityEntry) unlift() {
+	match := e.match
+	match.prev.next = match
+	if match.next != nil {
+		match.next.prev = match
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// linearizable will check if the history is linearizable using the
+// algorithm described by Wing & Gong (with the memoization described
+// by Lowe)
+func linearizable(history History) bool {
+	type event struct {
+		operation int
+		call      bool
+		time      time.Time
+	}
+	type frame struct {
+		entry *linearizabilityEntry
+		state registerState
+	}
+
+	if len(history) == 0 {
+		return true
+	}
+	events := make([]event, 0, 2*len(history))
+	for i := range history {
+		events = append(events,
+			event{operation: i, call: true, time: history[i].Invoke},
+			event{operation: i, call: false, time: history[i].Complete})
+	}
+	// calls are sorted before returns with the same time so operations
+	// that touch are considered concurrent
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time.Equal(events[j].time) {
+			return events[i].call && !events[j].call
+		}
+		return events[i].time.Before(events[j].time)
+	})
+	head := &linearizabilityEntry{operation: -1}
+	calls := make(map[int]*linearizabilityEntry, len(history))
+	prev := head
+	for _, e := range events {
+		entry := &linearizabilityEntry{operation: e.operation, call: e.call, prev: prev}
+		if e.call {
+			calls[e.operation] = entry
+		} else {
+			calls[e.operation].match = entry
+		}
+		prev.next, prev = entry, entry
+	}
+	var stack []frame
+	var state registerState
+	linearized := new(big.Int)
+	cache := make(map[string]bool)
+	entry := head.next
+	for head.next != nil {
+		if !entry.call {
+			if len(stack) == 0 {
+				return false
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			state = f.state
+			linearized.SetBit(linearized, f.entry.operation, 0)
+			f.entry.unlift()
+			entry = f.entry.next
+			continue
+		}
+		if next, ok := state.step(&history[entry.operation]); ok {
+			candidate := new(big.Int).SetBit(linearized, entry.operation, 1)
+			key := fmt.Sprintf("%x:%t:%d", candidate.Bytes(), next.known, next.version)
+			if !cache[key] {
+				cache[key] = true
+				stack = append(stack, frame{entry: entry, state: state})
+				state, linearized = next, candidate
+				entry.lift()
+				entry = head.next
+				continue
+			}
+		}
+		entry = entry.next
+	}
+	return true
+}
+
+// minimalViolation will find a minimal subsequence of a history that isn't
+// linearizable, it searches for the shortest prefix (in order of completion)
+// that isn't linearizable and then removes every operation that isn't
+// required for the violation
+func minimalViolation(history History) History {
+	sorted := append(History{}, history...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Complete.Before(sorted[j].Complete)
+	})
+	low, high := 0, len(sorted)
+	for high-low > 1 {
+		middle := (low + high) / 2
+		if linearizable(sorted[:middle]) {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+	violation := append(History{}, sorted[:high]...)
+	for i := len(violation) - 1; i >= 0; i-- {
+		candidate := append(append(History{}, violation[:i]...), violation[i+1:]...)
+		if !linearizable(candidate) {
+			violation = candidate
+		}
+	}
+	return violation
+}
+
+// CheckLinearizability will check if the history is linearizable and, if
+// it isn't, find the minimal violating subsequence
+func CheckLinearizability(history History) *LinearizabilityResult {
+	result := &LinearizabilityResult{
+		Linearizable: linearizable(history),
+		Operations:   len(history),
+	}
+	if !result.Linearizable {
+		result.Violation = minimalViolation(history)
+	}
+	return result
+}
+
+// printLinearizability will print the linearizability result
+func printLinearizability(w io.Writer, result *LinearizabilityResult) {
+	fmt.Fprintf(w, "linearizable: %t (%d operations)\n", result.Linearizable, result.Operations)
+	if result.Linearizable {
+		return
+	}
+	fmt.Fprintln(w, "violation:")
+	for _, operation := range result.Violation {
+		written := ""
+		if operation.Kind == OperationWrite {
+			written = fmt.Sprintf(" -> %d", operation.Written)
+		}
+		fmt.Fprintf(w, " process [%d] go routine [%d] %s %d%s [%s, %s]\n",
+			operation.Process, operation.GoRoutine, operation.Kind, operation.Read, written,
+			operation.Invoke.Format(time.RFC3339Nano), operation.Complete.Format(time.RFC3339Nano))
+	}
+}
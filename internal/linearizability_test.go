@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+// operation returns an operation invoked and completed at the given
+// offsets (in milliseconds)
+func operation(goRoutine int, kind string, read, written, invoke, complete int) Operation {
+	t := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return Operation{
+		GoRoutine: goRoutine,
+		Kind:      kind,
+		Read:      read,
+		Written:   written,
+		Invoke:    t.Add(time.Duration(invoke) * time.Millisecond),
+		Complete:  t.Add(time.Duration(complete) * time.Millisecond),
+	}
+}
+
+func TestCheckLinearizability(t *testing.T) {
+	for name, test := range map[string]struct {
+		history      History
+		linearizable bool
+		violation    History
+	}{
+		"empty": {
+			linearizable: true,
+		},
+		"sequential": {
+			history: History{
+				operation(0, OperationWrite, 0, 1, 0, 1),
+				operation(1, OperationWrite, 1, 2, 2, 3),
+				operation(0, OperationRead, 2, 0, 4, 5),
+			},
+			linearizable: true,
+		},
+		"concurrent_writes": {
+			history: History{
+				operation(0, OperationWrite, 1, 2, 0, 10),
+				operation(1, OperationWrite, 0, 1, 1, 9),
+				operation(2, OperationRead, 2, 0, 11, 12),
+			},
+			linearizable: true,
+		},
+		"concurrent_read": {
+			history: History{
+				operation(0, OperationWrite, 0, 1, 0, 10),
+				operation(1, OperationRead, 0, 0, 5, 6),
+				operation(2, OperationRead, 1, 0, 5, 7),
+			},
+			linearizable: true,
+		},
+		"touching": {
+			history: History{
+				operation(0, OperationWrite, 0, 1, 0, 5),
+				operation(1, OperationRead, 0, 0, 5, 6),
+			},
+			linearizable: true,
+		},
+		// both go routines read the same version and replaced it, one of
+		// the updates is lost
+		"lost_update": {
+			history: History{
+				operation(0, OperationWrite, 0, 2, 0, 5),
+				operation(1, OperationWrite, 0, 1, 1, 4),
+			},
+			violation: History{
+				operation(1, OperationWrite, 0, 1, 1, 4),
+				operation(0, OperationWrite, 0, 2, 0, 5),
+			},
+		},
+		"lost_update_minimal": {
+			history: History{
+				operation(0, OperationWrite, 0, 1, 0, 1),
+				operation(1, OperationWrite, 1, 2, 2, 3),
+				operation(0, OperationWrite, 2, 3, 4, 8),
+				operation(1, OperationWrite, 2, 4, 5, 9),
+				operation(2, OperationWrite, 4, 5, 10, 11),
+			},
+			violation: History{
+				operation(0, OperationWrite, 2, 3, 4, 8),
+				operation(1, OperationWrite, 2, 4, 5, 9),
+			},
+		},
+		"stale_read": {
+			history: History{
+				operation(0, OperationWrite, 0, 1, 0, 1),
+				operation(0, OperationWrite, 1, 2, 2, 3),
+				operation(1, OperationRead, 2, 0, 4, 5),
+				operation(1, OperationRead, 1, 0, 6, 7),
+			},
+			violation: History{
+				operation(0, OperationWrite, 1, 2, 2, 3),
+				operation(1, OperationRead, 1, 0, 6, 7),
+			},
+		},
+		"duplicate_write": {
+			history: History{
+				operation(0, OperationRead, 0, 0, 0, 1),
+				operation(0, OperationWrite, 0, 1, 2, 3),
+				operation(1, OperationWrite, 0, 1, 4, 5),
+			},
+			violation: History{
+				operation(0, OperationWrite, 0, 1, 2, 3),
+				operation(1, OperationWrite, 0, 1, 4, 5),
+			},
+		},
+		// a version can be written by a mutation that isn't in the history
+		// (e.g., it failed after writing)
+		"skipped_version": {
+			history: History{
+				operation(0, OperationWrite, 0, 2, 0, 1),
+				operation(1, OperationWrite, 2, 3, 2, 3),
+			},
+			linearizable: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			result := CheckLinearizability(test.history)
+			if result.Linearizable != test.linearizable {
+				t.Fatalf("expected linearizable %t, got %t", test.linearizable, result.Linearizable)
+			}
+			if result.Operations != len(test.history) {
+				t.Fatalf("expected %d operations, got %d", len(test.history), result.Operations)
+			}
+			if len(result.Violation) != len(test.violation) {
+				t.Fatalf("expected violation %v, got %v", test.violation, result.Violation)
+			}
+			for i := range test.violation {
+				if result.Violation[i] != test.violation[i] {
+					t.Fatalf("expected violation %v, got %v", test.violation, result.Violation)
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryRecord(t *testing.T) {
+	var history History
+
+	tInvoke := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tComplete := tInvoke.Add(time.Millisecond)
+	// the version read is recorded rather than the version replaced by
+	// the update, so lost updates aren't linearizable
+	history.record(3, &Employee{Version: 1}, &Employee{Version: 2}, tInvoke, tComplete)
+	history.record(4, &Employee{Version: 1}, &Employee{Version: 3}, tInvoke, tComplete)
+	expected := History{
+		{GoRoutine: 3, Kind: OperationWrite, Read: 1, Written: 2, Invoke: tInvoke, Complete: tComplete},
+		{GoRoutine: 4, Kind: OperationWrite, Read: 1, Written: 3, Invoke: tInvoke, Complete: tComplete},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("expected %d operations, got %v", len(expected), history)
+	}
+	for i := range expected {
+		if history[i] != expected[i] {
+			t.Fatalf("operation %d: expected %+v, got %+v", i, expected[i], history[i])
+		}
+	}
+	if result := CheckLinearizability(history); result.Linearizable || len(result.Violation) != 2 {
+		t.Fatalf("expected the lost update to be a violation: %+v", result)
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const usageLocks string = `usage: locks <command> [flags] [arguments]
+
+commands:
+ list                         list all of the locks that are currently held
+ show <name>                  show the lock with the given name
+ release --force <name>       release the lock with the given name regardless of owner
+ ttl <name> <duration>        set the remaining time to live for the lock with the given name
+
+flags:
+ --backend=redis|redis_redshift|mysql  the backend whose locks are administrated (default: MUTEX_TYPE)
+ --output=table|json                   the format of the output (default: table)
+`
+
+// acquire will attempt to lock (using tryLockFx) at the retry interval
+// until successful or the context is done; if the lock isn't acquired
+// cleanupFx will be executed (e.g., to remove the waiter). tryLockFx must
+// not return an error once the lock is acquired, the caller would have no
+// way to release it
+func acquire(ctx context.Context, retryInterval time.Duration,
+	tryLockFx func() (bool, error), cleanupFx func() error) (err error) {
+	var locked bool
+
+	defer func() {
+		if !locked {
+			if err := cleanupFx(); err != nil {
+				fmt.Printf("error occured while cleaning up: \"%s\"\n", err)
+			}
+		}
+	}()
+	if locked, err = tryLockFx(); err != nil || locked {
+		return err
+	}
+	tRetry := time.NewTicker(retryInterval)
+	defer tRetry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tRetry.C:
+			if locked, err = tryLockFx(); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+			if locked {
+				return nil
+			}
+		}
+	}
+}
+
+func newLocker(config *Configuration) (interface {
+	Locker
+	LockAdmin
+	Close() error
+}, error) {
+	switch config.MutexType {
+	default:
+		return nil, errors.New("unsupported mutex type")
+	case "redis_redshift":
+		return NewRedSyncLocker(config)
+	case "redis":
+		return NewRedisLocker(config)
+	}
+}
+
+// newLockAdmin will create the lock admin for the given backend, the redis
+// backends administrate the locks of their mutexes while the mysql backend
+// administrates the row locks held on the employee table
+func newLockAdmin(config *Configuration, backend string) (interface {
+	LockAdmin
+	Close() error
+}, error) {
+	if backend == "mysql" {
+		return NewMysqlLockAdmin(config)
+	}
+	c := *config
+	c.MutexType = backend
+	return newLocker(&c)
+}
+
+func printLocks(output string, locks ...*LockInfo) error {
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", " ")
+		return encoder.Encode(locks)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tOWNER\tTOKEN\tTTL\tWAITERS")
+		for _, lock := range locks {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", lock.Name, lock.Owner,
+				lock.Token, lock.TTL.Round(time.Millisecond), lock.Waiters)
+		}
+		return w.Flush()
+	}
+}
+
+func mainLocks(config *Configuration, args []string) error {
+	var output, backend string
+	var force bool
+
+	if len(args) == 0 {
+		fmt.Print(usageLocks)
+		return errors.New("locks requires a command")
+	}
+	command := args[0]
+	switch command {
+	default:
+		fmt.Print(usageLocks)
+		return errors.Errorf("unsupported command: %q", command)
+	case "list", "show", "release", "ttl":
+	}
+	flagSet := flag.NewFlagSet("locks "+command, flag.ContinueOnError)
+	flagSet.StringVar(&backend, "backend", config.MutexType, "the backend whose locks are administrated (redis, redis_redshift or mysql)")
+	flagSet.StringVar(&output, "output", "table", "the format of the output (table or json)")
+	if command == "release" {
+		flagSet.BoolVar(&force, "force", false, "release the lock regardless of owner")
+	}
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = flagSet.Args()
+	admin, err := newLockAdmin(config, backend)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := admin.Close(); err != nil {
+			fmt.Printf("error occured while closing the lock admin: \"%s\"\n", err)
+		}
+	}()
+	ctx := context.Background()
+	switch command {
+	case "list":
+		locks, err := admin.List(ctx)
+		if err != nil {
+			return err
+		}
+		return printLocks(output, locks...)
+	case "show":
+		if len(args) != 1 {
+			return errors.New("show requires a lock name")
+		}
+		lock, err := admin.Show(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return printLocks(output, lock)
+	case "release":
+		if len(args) != 1 {
+			return errors.New("release requires a lock name")
+		}
+		if !force {
+			return errors.New("release requires --force")
+		}
+		return admin.ForceRelease(ctx, args[0])
+	case "ttl":
+		if len(args) != 2 {
+			return errors.New("ttl requires a lock name and duration")
+		}
+		ttl, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			return errors.New("ttl must be positive")
+		}
+		return admin.SetTTL(ctx, args[0], ttl)
+	}
+	return nil
+}
@@ -1,87 +1,94 @@
 package internal
 
 import (
-	"database/sql"
-	"errors"
+	"context"
+	"flag"
 	"fmt"
+	"math"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
+
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func employeeConcurrentMutateBenchmark(config *Configuration, chOsSignal chan (os.Signal),
-	mutateFx func(goRoutine int) error) error {
+// employeeConcurrentMutate will run the scenario with the configured number
+// of go routines for the configured duration and return the result; with a
+// closed loop each go routine mutates on a fixed interval (ticks are dropped
+// when a mutation is slow), with an open loop mutations are scheduled at a
+// fixed rate and executed by the go routines (as a worker pool)
+func employeeConcurrentMutate(config *Configuration, chOsSignal chan (os.Signal),
+	scenario Scenario, mode string, options runOptions) (*Result, error) {
 	var wg sync.WaitGroup
 
-	start := make(chan struct{})
-	stopper := make(chan struct{})
-	defer func() {
-		select {
-		default:
-			close(start)
-		case <-start:
+	result := &Result{
+		Scenario:         scenario.Name(),
+		Mode:             mode,
+		Backend:          scenarioBackend(config, scenario),
+		IsolationLevel:   config.IsolationLevel,
+		Load:             LoadClosed,
+		Processes:        1,
+		GoRoutines:       config.GoRoutines,
+		Interval:         config.MutateInterval,
+		GoRoutineResults: make([]*GoRoutineResult, config.GoRoutines),
+	}
+	if options.load == LoadOpen {
+		interval, err := rateInterval(options.rate)
+		if err != nil {
+			return nil, err
 		}
-	}()
-	for i := range config.GoRoutines {
-		started := make(chan struct{})
-		wg.Add(1)
-		go func(goRoutine int) {
-			defer wg.Done()
-
-			var totalMutations, totalErrors int
-			var totalDuration time.Duration
-
-			defer func() {
+		result.Load, result.Rate, result.Interval = LoadOpen, options.rate, interval
+	}
+	timedScenario, timed := scenario.(TimedScenario)
+	retryingScenario, retrying := scenario.(RetryingScenario)
+	// the context is canceled when interrupted such that mutations that
+	// are waiting (e.g., for a row lock) stop waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// mutate will mutate once and record the outcome, the latency is
+	// measured from the time the mutation was intended to start; the
+	// transactions retried by the repository (e.g., after a deadlock) are
+	// recorded as tx retries and every deadlock (retried or not) is
+	// recorded as a deadlock
+	mutate := func(goRoutine int, goRoutineResult *GoRoutineResult, tIntended time.Time) {
+		var employeeRead, employeeUpdated *Employee
+		var lockWait time.Duration
+		var retries, deadlocks atomic.Int64
+		var err error
 
-				average := "-"
-				if totalMutations > 0 {
-					average = (totalDuration / time.Duration(totalMutations)).String()
-				}
-				fmt.Printf("go routine [%d]:\n total mutations: %d\n average time: %s\n total errors: %d\n",
-					goRoutine,
-					totalMutations,
-					average,
-					totalErrors)
-			}()
-			tMutate := time.NewTicker(config.MutateInterval)
-			defer tMutate.Stop()
-			close(started)
-			<-start
-			for {
-				select {
-				case <-stopper:
-					return
-				case <-tMutate.C:
-					tStart := time.Now()
-					if err := mutateFx(goRoutine); err != nil {
-						totalErrors++
-						continue
-					}
-					totalDuration += time.Since(tStart)
-					totalMutations++
-				}
+		ctx := withDeadlocks(withRetries(ctx, &retries), &deadlocks)
+		tStart := time.Now()
+		if timed {
+			employeeRead, employeeUpdated, lockWait, err = timedScenario.MutateTimed(ctx, goRoutine)
+		} else {
+			employeeRead, employeeUpdated, err = scenario.Mutate(ctx, goRoutine)
+		}
+		goRoutineResult.TxRetries += int(retries.Load())
+		goRoutineResult.Deadlocks += int(deadlocks.Load())
+		if err != nil {
+			// mutations interrupted by the signal aren't errors
+			if ctx.Err() == nil {
+				goRoutineResult.Errors++
 			}
-		}(i)
-		<-started
-	}
-	close(start)
-	select {
-	case <-time.After(config.DemoDuration):
-	case <-chOsSignal:
+			return
+		}
+		tComplete := time.Now()
+		goRoutineResult.record(tComplete.Sub(tIntended), tStart.Sub(tIntended), lockWait, timed)
+		if options.history {
+			goRoutineResult.history.record(goRoutine, employeeRead, employeeUpdated, tStart, tComplete)
+		}
+		if !scenario.Consistent(employeeRead, employeeUpdated) {
+			goRoutineResult.Inconsistencies++
+		}
+		goRoutineResult.Mutations++
 	}
-	close(stopper)
-	wg.Wait()
-	return nil
-}
-
-func employeeConcurrentMutateDemo(config *Configuration, chOsSignal chan (os.Signal),
-	mutateFx func(goRoutine, dataInconsistencies int) (int, error)) error {
-	var wg sync.WaitGroup
-
 	start := make(chan struct{})
 	stopper := make(chan struct{})
+	work := make(chan time.Time)
 	defer func() {
 		select {
 		default:
@@ -91,18 +98,33 @@ func employeeConcurrentMutateDemo(config *Configuration, chOsSignal chan (os.Sig
 	}()
 	for i := range config.GoRoutines {
 		started := make(chan struct{})
+		goRoutineResult := &GoRoutineResult{GoRoutine: i}
+		result.GoRoutineResults[i] = goRoutineResult
 		wg.Add(1)
 		go func(goRoutine int) {
 			defer wg.Done()
 
-			var dataInconsistencies, totalErrors,
-				totalMutations int
-			var err error
+			// retries are counted by the scenario (which is shared
+			// across runs) so only the difference is recorded
+			if retrying {
+				retries := retryingScenario.Retries(goRoutine)
+				defer func() {
+					goRoutineResult.Retries += retryingScenario.Retries(goRoutine) - retries
+				}()
+			}
 
-			defer func() {
-				fmt.Printf("go routine [%d]:\n total mutations: %d\n data inconsistencies: %d\n total errors: %d\n",
-					goRoutine, totalMutations, dataInconsistencies, totalErrors)
-			}()
+			if options.load == LoadOpen {
+				close(started)
+				<-start
+				for {
+					select {
+					case <-stopper:
+						return
+					case tIntended := <-work:
+						mutate(goRoutine, goRoutineResult, tIntended)
+					}
+				}
+			}
 			tMutate := time.NewTicker(config.MutateInterval)
 			defer tMutate.Stop()
 			close(started)
@@ -112,147 +134,99 @@ func employeeConcurrentMutateDemo(config *Configuration, chOsSignal chan (os.Sig
 				case <-stopper:
 					return
 				case <-tMutate.C:
-					dataInconsistencies, err = mutateFx(goRoutine, dataInconsistencies)
-					if err != nil {
-						totalErrors++
-						continue
-					}
-					totalMutations++
+					mutate(goRoutine, goRoutineResult, time.Now())
 				}
 			}
 		}(i)
 		<-started
 	}
+	if options.load == LoadOpen {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			schedule(result, options.queueSize, start, stopper, work)
+		}()
+	}
+	tStart := time.Now()
 	close(start)
 	select {
 	case <-time.After(config.DemoDuration):
 	case <-chOsSignal:
+		result.Interrupted = true
+		cancel()
 	}
 	close(stopper)
 	wg.Wait()
-	return nil
-}
-
-func employeeCurrentMutateWithMutexBenchmark(config *Configuration, db *sql.DB, mu Mutex, chOsSignal chan (os.Signal), employee *Employee) error {
-	fmt.Println("\n=============================================")
-	fmt.Println("--Benchmarking Concurrent Mutate with Mutex--")
-	fmt.Println("=============================================")
-	return employeeConcurrentMutateBenchmark(config, chOsSignal, func(goRoutine int) error {
-		mu.Lock()
-		defer mu.Unlock()
-
-		if _, err := UpdateEmployee(db, employee); err != nil {
-			return err
-		}
-		return nil
-	})
-}
-
-func employeeCurrentMutateWithRowLockBenchmark(config *Configuration, db *sql.DB, chOsSignal chan (os.Signal), employee *Employee) error {
-	fmt.Println("\n================================================")
-	fmt.Println("--Benchmarking Concurrent Mutate with Row Lock--")
-	fmt.Println("================================================")
-	return employeeConcurrentMutateBenchmark(config, chOsSignal, func(goRoutine int) error {
-		if _, _, err := UpdateEmployeeWithLock(db, employee); err != nil {
-			return err
-		}
-		return nil
-	})
-}
-
-func employeeCurrentMutateWithVersionBenchmark(config *Configuration, db *sql.DB, chOsSignal chan (os.Signal), employee *Employee) error {
-	fmt.Println("\n===============================================")
-	fmt.Println("--Benchmarking Concurrent Mutate with Version--")
-	fmt.Println("===============================================")
-	return employeeConcurrentMutateBenchmark(config, chOsSignal, func(goRoutine int) error {
-		employeeRead, err := ReadEmployee(db, employee.EmailAddress)
-		if err != nil {
-			return err
-		}
-		if _, err := UpdateEmployeeWithVersion(db, employee, employeeRead.Version); err != nil {
-			return err
-		}
-		return nil
-	})
+	result.WallTime = time.Since(tStart)
+	result.aggregate()
+	if options.history {
+		result.checkLinearizability()
+	}
+	return result, nil
 }
 
-func employeeCurrentMutateNoMutex(config *Configuration, db *sql.DB, chOsSignal chan (os.Signal), employee *Employee) error {
-	fmt.Println("\n===========================================")
-	fmt.Println("--Testing Concurrent Mutate with no Mutex--")
-	fmt.Println("===========================================")
-	return employeeConcurrentMutateDemo(config, chOsSignal, func(goRoutine, dataInconsistencies int) (int, error) {
-		employeeRead, err := ReadEmployee(db, employee.EmailAddress)
-		if err != nil {
-			return dataInconsistencies, err
-		}
-		employeeUpdated, err := UpdateEmployee(db, employee)
-		if err != nil {
-			return dataInconsistencies, err
-		}
-		if employeeUpdated.Version != employeeRead.Version+1 {
-			dataInconsistencies++
-		}
-		return dataInconsistencies, nil
-	})
+// rateInterval returns the interval between mutations scheduled at the
+// given rate (per second), mutations can't be scheduled unless the
+// interval is at least a nanosecond and fits in a duration
+func rateInterval(rate float64) (time.Duration, error) {
+	if !(rate > 0) {
+		return 0, errors.New("rate must be positive for an open load")
+	}
+	interval := float64(time.Second) / rate
+	if interval < 1 {
+		return 0, errors.Errorf("rate must be at most %d per second, got %g", time.Second, rate)
+	}
+	if interval >= math.MaxInt64 {
+		return 0, errors.Errorf("rate is too low, got %g", rate)
+	}
+	return time.Duration(interval), nil
 }
 
-func employeeCurrentMutateWithMutexDemo(config *Configuration, db *sql.DB, mu Mutex, chOsSignal chan (os.Signal), employee *Employee) error {
-	fmt.Println("\n========================================")
-	fmt.Println("--Testing Concurrent Mutate with Mutex--")
-	fmt.Println("========================================")
-	return employeeConcurrentMutateDemo(config, chOsSignal, func(goRoutine, dataInconsistencies int) (int, error) {
-		mu.Lock()
-		defer mu.Unlock()
-
-		employeeRead, err := ReadEmployee(db, employee.EmailAddress)
-		if err != nil {
-			return dataInconsistencies, err
-		}
-		employeeUpdated, err := UpdateEmployee(db, employee)
-		if err != nil {
-			return dataInconsistencies, err
-		}
-		if employeeUpdated.Version != employeeRead.Version+1 {
-			dataInconsistencies++
-		}
-		return dataInconsistencies, nil
-	})
-}
+// schedule will schedule mutations at the result's interval (open loop)
+// until stopped; a mutation is handed to an idle go routine or queued if
+// none is idle and it's missed if the queue is full (or it's still queued
+// once stopped)
+func schedule(result *Result, queueSize int, start, stopper <-chan struct{},
+	work chan<- time.Time) {
+	var queue []time.Time
 
-func employeeCurrentMutateWithRowLockDemo(config *Configuration, db *sql.DB, chOsSignal chan (os.Signal), employee *Employee) error {
-	fmt.Println("\n===========================================")
-	fmt.Println("--Testing Concurrent Mutate with Row Lock--")
-	fmt.Println("===========================================")
-	return employeeConcurrentMutateDemo(config, chOsSignal, func(goRoutine, dataInconsistencies int) (int, error) {
-		employeeRead, employeeUpdated, err := UpdateEmployeeWithLock(db, employee)
-		if err != nil {
-			return dataInconsistencies, err
-		}
-		if employeeUpdated.Version != employeeRead.Version+1 {
-			dataInconsistencies++
-		}
-		return dataInconsistencies, nil
-	})
-}
+	<-start
+	tNext := time.Now()
+	tSchedule := time.NewTimer(0)
+	defer tSchedule.Stop()
+	for {
+		var chWork chan<- time.Time
+		var tHead time.Time
 
-func employeeCurrentMutateWithVersionDemo(config *Configuration, db *sql.DB, chOsSignal chan (os.Signal), employee *Employee) error {
-	fmt.Println("\n==========================================")
-	fmt.Println("--Testing Concurrent Mutate with Version--")
-	fmt.Println("==========================================")
-	return employeeConcurrentMutateDemo(config, chOsSignal, func(goRoutine, dataInconsistencies int) (int, error) {
-		employeeRead, err := ReadEmployee(db, employee.EmailAddress)
-		if err != nil {
-			return dataInconsistencies, err
+		if len(queue) > 0 {
+			chWork, tHead = work, queue[0]
 		}
-		employeeUpdated, err := UpdateEmployeeWithVersion(db, employee, employeeRead.Version)
-		if err != nil {
-			return dataInconsistencies, err
-		}
-		if employeeUpdated.Version != employeeRead.Version+1 {
-			dataInconsistencies++
+		select {
+		case <-stopper:
+			result.Missed += len(queue)
+			return
+		case chWork <- tHead:
+			queue = queue[1:]
+		case <-tSchedule.C:
+			for now := time.Now(); !tNext.After(now); tNext = tNext.Add(result.Interval) {
+				result.Scheduled++
+				if len(queue) == 0 {
+					select {
+					case work <- tNext:
+						continue
+					default:
+					}
+				}
+				if len(queue) >= queueSize {
+					result.Missed++
+					continue
+				}
+				queue = append(queue, tNext)
+				result.Queued++
+			}
+			tSchedule.Reset(time.Until(tNext))
 		}
-		return dataInconsistencies, nil
-	})
+	}
 }
 
 func newMutex(config *Configuration) (interface {
@@ -273,68 +247,351 @@ func newMutex(config *Configuration) (interface {
 			return nil, err
 		}
 		return mutex, nil
+	case "remote":
+		return newRemoteMutex(config), nil
 	}
 }
 
-func Main(pwd string, args []string, envs map[string]string, chOsSignal chan os.Signal) error {
-	const (
-		firstName    string = "Antonio"
-		lastName     string = "Alexander"
-		emailAddress string = "antonio.alexander@mistersoftwaredeveloper.com"
-	)
+// printScenarioBanner will print the banner for the scenario and mode
+func printScenarioBanner(scenario Scenario, mode string) {
+	title := "Testing "
+	if mode == "benchmark" {
+		title = "Benchmarking "
+	}
+	printBanner(title + scenario.Description())
+}
 
-	config := ConfigFromEnv(envs)
-	fmt.Printf("Configuration:\n mutex: %s\n go routines: %d\n duration: %s\n interval: %s\n",
-		config.MutexType, config.GoRoutines, config.DemoDuration.String(), config.MutateInterval.String())
-	db, err := NewSql(config)
-	if err != nil {
-		return err
+// runOptions describes how scenarios are run
+type runOptions struct {
+	// verbose will print the results as text while running
+	verbose bool
+
+	// history will record the history of operations and check if
+	// it's linearizable
+	history bool
+
+	// load is either a closed loop (each go routine mutates on an
+	// interval) or an open loop (mutations are scheduled at the rate,
+	// per second, with at most queueSize mutations queued)
+	load      string
+	rate      float64
+	queueSize int
+
+	// ready (if not nil) is executed before each run starts
+	ready func() error
+}
+
+// runScenario will setup the scenario, run it in the given mode
+// (demo, benchmark or all) and then tear it down
+func runScenario(config *Configuration, chOsSignal chan os.Signal,
+	env *ScenarioEnvironment, scenario Scenario, mode string,
+	options runOptions) ([]*Result, error) {
+	var results []*Result
+
+	if err := scenario.Setup(env); err != nil {
+		return nil, err
 	}
 	defer func() {
-		if err := db.Close(); err != nil {
-			fmt.Printf("error occured while closing the database: \"%s\"\n", err)
+		if err := scenario.Teardown(); err != nil {
+			fmt.Printf("error occured while tearing down %s: \"%s\"\n", scenario.Name(), err)
 		}
 	}()
-	mutex, err := newMutex(config)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := mutex.Close(); err != nil {
-			fmt.Printf("error occured while closing the mutex: \"%s\"\n", err)
+	for _, m := range []string{"demo", "benchmark"} {
+		if mode != m && mode != "all" {
+			continue
 		}
-	}()
-	if err := DeleteEmployee(db, emailAddress); err != nil {
-		return err
+		if options.verbose {
+			printScenarioBanner(scenario, m)
+		}
+		if options.ready != nil {
+			if err := options.ready(); err != nil {
+				return nil, err
+			}
+		}
+		result, err := employeeConcurrentMutate(config, chOsSignal, scenario, m, options)
+		if err != nil {
+			return nil, err
+		}
+		if options.verbose {
+			printResult(os.Stdout, result)
+		}
+		results = append(results, result)
+		if result.Interrupted {
+			break
+		}
+	}
+	return results, nil
+}
+
+// writeResultsFile will write the results to the given file, or to
+// stdout if no file is given
+func writeResultsFile(output, outputFile string, results []*Result) error {
+	if outputFile == "" {
+		return WriteResults(os.Stdout, output, results)
 	}
-	employee, err := CreateEmployee(db, &Employee{
-		FirstName:    firstName,
-		LastName:     lastName,
-		EmailAddress: emailAddress,
-	})
+	file, err := os.Create(outputFile)
 	if err != nil {
 		return err
 	}
-	if err := employeeCurrentMutateNoMutex(config, db, chOsSignal, employee); err != nil {
+	if err := WriteResults(file, output, results); err != nil {
+		file.Close()
 		return err
 	}
-	if err := employeeCurrentMutateWithMutexDemo(config, db, mutex, chOsSignal, employee); err != nil {
+	return file.Close()
+}
+
+// newEmployee returns the employee that's mutated by default
+func newEmployee() *Employee {
+	return &Employee{
+		FirstName:    "Antonio",
+		LastName:     "Alexander",
+		EmailAddress: "antonio.alexander@mistersoftwaredeveloper.com",
+	}
+}
+
+const usageRun string = `usage: run [flags]
+
+flags:
+`
+
+func mainRun(config *Configuration, args []string, chOsSignal chan os.Signal) error {
+	var scenarioList, mode, output, outputFile string
+	var listScenarios, child, history bool
+	var processes, queueSize int
+	var load string
+	var rate float64
+
+	employee := newEmployee()
+	flagSet := flag.NewFlagSet("run", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprint(flagSet.Output(), usageRun)
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&scenarioList, "scenario", "", "comma separated list of scenarios to run (default: all)")
+	flagSet.StringVar(&mode, "mode", "all", "the mode to run the scenarios in (demo, benchmark or all)")
+	flagSet.StringVar(&output, "output", OutputText, "the format of the results (text, json or csv)")
+	flagSet.StringVar(&outputFile, "output-file", "", "the file to write the results to (default: stdout)")
+	flagSet.BoolVar(&listScenarios, "list-scenarios", false, "list the available scenarios and exit")
+	flagSet.IntVar(&processes, "processes", 1, "the number of processes to run each scenario with (each with its own connections)")
+	flagSet.StringVar(&load, "load", LoadClosed, "closed (each go routine mutates on the interval) or open (mutations are scheduled at the rate)")
+	flagSet.Float64Var(&rate, "rate", 0, "the number of mutations scheduled per second (open load)")
+	flagSet.IntVar(&queueSize, "queue-size", 1000, "the maximum number of mutations queued when all go routines are busy (open load)")
+	flagSet.BoolVar(&history, "history", false, "record the history of operations and check if it's linearizable")
+	flagSet.BoolVar(&child, "child", false, "run as a child of the coordinator (used by --processes)")
+	flagSet.StringVar(&config.MutexType, "mutex-type", config.MutexType, "the type of mutex (redis, redis_redshift or remote)")
+	flagSet.StringVar(&config.IsolationLevel, "isolation-level", config.IsolationLevel, "the isolation level of the mysql transactions (read-uncommitted, read-committed, repeatable-read or serializable)")
+	flagSet.IntVar(&config.GoRoutines, "goroutines", config.GoRoutines, "the number of go routines mutating concurrently")
+	flagSet.DurationVar(&config.DemoDuration, "duration", config.DemoDuration, "how long each scenario runs")
+	flagSet.DurationVar(&config.MutateInterval, "interval", config.MutateInterval, "how often each go routine mutates")
+	flagSet.StringVar(&employee.EmailAddress, "email-address", employee.EmailAddress, "the email address of the employee to mutate")
+	flagSet.StringVar(&employee.FirstName, "first-name", employee.FirstName, "the first name of the employee to mutate")
+	flagSet.StringVar(&employee.LastName, "last-name", employee.LastName, "the last name of the employee to mutate")
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
 		return err
 	}
-	if err := employeeCurrentMutateWithMutexBenchmark(config, db, mutex, chOsSignal, employee); err != nil {
+	if listScenarios {
+		for _, scenario := range Scenarios() {
+			fmt.Printf("%s: %s\n", scenario.Name(), scenario.Description())
+		}
+		return nil
+	}
+	switch mode {
+	default:
+		return errors.Errorf("unsupported mode: %q", mode)
+	case "demo", "benchmark", "all":
+	}
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case OutputText, OutputJSON, OutputCSV:
+	}
+	switch load {
+	default:
+		return errors.Errorf("unsupported load: %q", load)
+	case LoadClosed:
+	case LoadOpen:
+		if _, err := rateInterval(rate); err != nil {
+			return err
+		}
+		if queueSize < 0 {
+			return errors.New("queue-size can't be negative")
+		}
+	}
+	if processes <= 0 {
+		return errors.New("processes must be positive")
+	}
+	if processes > 1 && config.EmployeeStore == EmployeeStoreMemory {
+		return errors.New("the memory employee store can't be shared across processes")
+	}
+	if err := config.Validate(); err != nil {
 		return err
 	}
-	if err := employeeCurrentMutateWithRowLockDemo(config, db, chOsSignal, employee); err != nil {
+	selected, supported := make(map[string]bool), make(map[string]bool)
+	for _, scenario := range Scenarios() {
+		supported[scenario.Name()] = true
+	}
+	if scenarioList != "" {
+		for _, name := range strings.Split(scenarioList, ",") {
+			name = strings.TrimSpace(name)
+			if !supported[name] {
+				return errors.Errorf("unsupported scenario: %q", name)
+			}
+			selected[name] = true
+		}
+	}
+	// text is printed while running unless machine readable results
+	// are written to stdout
+	verbose := !child && (output == OutputText || outputFile != "")
+	if verbose {
+		fmt.Printf("Configuration:\n employee store: %s\n mutex: %s\n processes: %d\n go routines: %d\n duration: %s\n interval: %s\n",
+			config.EmployeeStore, config.MutexType, processes, config.GoRoutines, config.DemoDuration.String(), config.MutateInterval.String())
+	}
+	repository, err := newRepository(config)
+	if err != nil {
 		return err
 	}
-	if err := employeeCurrentMutateWithRowLockBenchmark(config, db, chOsSignal, employee); err != nil {
+	defer func() {
+		if err := repository.Close(); err != nil {
+			fmt.Printf("error occured while closing the database: \"%s\"\n", err)
+		}
+	}()
+	// the coordinator creates the employee, children mutate the
+	// employee it created
+	if child {
+		employee, err = repository.ReadEmployee(context.Background(), employee.EmailAddress)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := repository.DeleteEmployee(context.Background(), employee.EmailAddress); err != nil {
+			return err
+		}
+		if employee, err = repository.CreateEmployee(context.Background(), employee); err != nil {
+			return err
+		}
+	}
+	env := &ScenarioEnvironment{
+		Config:     config,
+		Repository: repository,
+		Employee:   employee,
+	}
+	options := runOptions{
+		verbose:   verbose,
+		history:   history,
+		load:      load,
+		rate:      rate,
+		queueSize: queueSize,
+	}
+	if child {
+		options.ready = childBarrier(chOsSignal)
+	}
+	var results []*Result
+	for _, scenario := range Scenarios() {
+		if interrupted(results) {
+			break
+		}
+		if len(selected) > 0 && !selected[scenario.Name()] {
+			continue
+		}
+		if processes > 1 {
+			for _, m := range []string{"demo", "benchmark"} {
+				if mode != m && mode != "all" {
+					continue
+				}
+				if verbose {
+					printScenarioBanner(scenario, m)
+				}
+				result, err := coordinate(config, chOsSignal, scenario, m, processes, employee, options)
+				if err != nil {
+					return err
+				}
+				if verbose {
+					printResult(os.Stdout, result)
+				}
+				results = append(results, result)
+				if result.Interrupted {
+					break
+				}
+			}
+			continue
+		}
+		scenarioResults, err := runScenario(config, chOsSignal, env, scenario, mode, options)
+		if err != nil {
+			return err
+		}
+		results = append(results, scenarioResults...)
+	}
+	if child {
+		return writeChildResults(os.Stdout, results)
+	}
+	if output == OutputText && outputFile == "" {
+		return nil
+	}
+	return writeResultsFile(output, outputFile, results)
+}
+
+// configFlag will remove the config flag from the arguments (it can be
+// given before or after the command) and return the configuration file
+func configFlag(args []string) (string, []string, error) {
+	var file string
+	var remaining []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			remaining = append(remaining, args[i:]...)
+			break
+		}
+		switch {
+		default:
+			remaining = append(remaining, arg)
+		case arg == "--config" || arg == "-config":
+			if i+1 >= len(args) {
+				return "", nil, errors.New("flag needs an argument: --config")
+			}
+			i++
+			file = args[i]
+		case strings.HasPrefix(arg, "--config="), strings.HasPrefix(arg, "-config="):
+			file = arg[strings.Index(arg, "=")+1:]
+		}
+	}
+	return file, remaining, nil
+}
+
+func Main(pwd string, args []string, envs map[string]string, chOsSignal chan os.Signal) error {
+	file, args, err := configFlag(args)
+	if err != nil {
 		return err
 	}
-	if err := employeeCurrentMutateWithVersionDemo(config, db, chOsSignal, employee); err != nil {
+	config, err := LoadConfiguration(file, envs)
+	if err != nil {
 		return err
 	}
-	if err := employeeCurrentMutateWithVersionBenchmark(config, db, chOsSignal, employee); err != nil {
+	if err := config.Validate(); err != nil {
 		return err
 	}
-	return nil
+	if len(args) > 0 {
+		switch args[0] {
+		case "locks":
+			return mainLocks(config, args[1:])
+		case "serve":
+			return mainServe(config, args[1:], chOsSignal)
+		case "run":
+			return mainRun(config, args[1:], chOsSignal)
+		case "chaos":
+			return mainChaos(config, args[1:], chOsSignal)
+		case "sweep":
+			return mainSweep(config, args[1:], chOsSignal)
+		case "workload":
+			return mainWorkload(config, args[1:], chOsSignal)
+		case "migrate":
+			return mainMigrate(config, args[1:])
+		case "isolation":
+			return mainIsolation(config, args[1:], chOsSignal)
+		}
+	}
+	return mainRun(config, args, chOsSignal)
 }
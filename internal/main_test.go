@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateInterval(t *testing.T) {
+	for name, test := range map[string]struct {
+		rate     float64
+		interval time.Duration
+		fail     bool
+	}{
+		"one":           {rate: 1, interval: time.Second},
+		"fraction":      {rate: 0.5, interval: 2 * time.Second},
+		"thousand":      {rate: 1000, interval: time.Millisecond},
+		"maximum":       {rate: 1e9, interval: time.Nanosecond},
+		"too_high":      {rate: 1e9 + 1, fail: true},
+		"infinite":      {rate: math.Inf(1), fail: true},
+		"too_low":       {rate: 1e-10, fail: true},
+		"zero":          {rate: 0, fail: true},
+		"negative":      {rate: -1, fail: true},
+		"not_a_number":  {rate: math.NaN(), fail: true},
+		"per_process":   {rate: 1e9 / 3, interval: 3 * time.Nanosecond},
+		"lowest_viable": {rate: 1e-9, interval: time.Duration(1e18)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			interval, err := rateInterval(test.rate)
+			if test.fail {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", interval)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if interval != test.interval {
+				t.Fatalf("expected %s, got %s", test.interval, interval)
+			}
+		})
+	}
+}
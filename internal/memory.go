@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// memoryRow is a single employee, the lock is held exclusively by the
+// transaction that's updating (or has selected for update) the row
+type memoryRow struct {
+	sync.Mutex
+	lock     chan struct{}
+	employee Employee
+	deleted  bool
+}
+
+func (r *memoryRow) read() (Employee, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.employee, !r.deleted
+}
+
+// memoryTx simulates a transaction, rows are locked until the transaction
+// is committed (or rolled back) and writes aren't visible to others until
+// the transaction is committed
+type memoryTx struct {
+	locked []*memoryRow
+	writes map[*memoryRow]Employee
+}
+
+// lock will block until the transaction holds the row lock or the
+// context is done
+func (tx *memoryTx) lock(ctx context.Context, row *memoryRow) error {
+	for _, r := range tx.locked {
+		if r == row {
+			return nil
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case row.lock <- struct{}{}:
+	}
+	tx.locked = append(tx.locked, row)
+	return nil
+}
+
+// read will read the row, the transaction's own writes are visible
+func (tx *memoryTx) read(row *memoryRow) (Employee, bool) {
+	if employee, ok := tx.writes[row]; ok {
+		return employee, true
+	}
+	return row.read()
+}
+
+func (tx *memoryTx) write(row *memoryRow, employee Employee) {
+	if tx.writes == nil {
+		tx.writes = make(map[*memoryRow]Employee)
+	}
+	tx.writes[row] = employee
+}
+
+// update will write the employee's names to the row (incrementing the
+// version) within the transaction
+func (tx *memoryTx) update(row *memoryRow, employeeRow Employee, employee *Employee) *Employee {
+	employeeRow.FirstName, employeeRow.LastName = employee.FirstName, employee.LastName
+	employeeRow.Version++
+	tx.write(row, employeeRow)
+	return &employeeRow
+}
+
+func (tx *memoryTx) commit() {
+	for row, employee := range tx.writes {
+		row.Lock()
+		row.employee = employee
+		row.Unlock()
+	}
+	tx.writes = nil
+	tx.rollback()
+}
+
+func (tx *memoryTx) rollback() {
+	for _, row := range tx.locked {
+		<-row.lock
+	}
+	tx.locked, tx.writes = nil, nil
+}
+
+// MemoryRepository is an employee repository that's kept in memory, it
+// models the semantics of the mysql repository: reads don't block, updates
+// lock the row until they're committed, SELECT ... FOR UPDATE blocks until
+// the row lock is available and updates with a version only succeed if the
+// version is current. The latency is injected between reading and writing
+// (e.g., before an update) such that the window for lost updates is wide
+// enough to be reproduced reliably; each call is limited to the timeout
+type MemoryRepository struct {
+	sync.RWMutex
+	rows    map[string]*memoryRow
+	latency time.Duration
+	timeout time.Duration
+}
+
+func NewMemoryRepository(latency, timeout time.Duration) *MemoryRepository {
+	return &MemoryRepository{
+		rows:    make(map[string]*memoryRow),
+		latency: latency,
+		timeout: timeout,
+	}
+}
+
+func (m *MemoryRepository) Close() error {
+	return nil
+}
+
+// row will return the row for the given email address, rows are only
+// removed from the map once they're deleted
+func (m *MemoryRepository) row(emailAddress string) (*memoryRow, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	row, ok := m.rows[emailAddress]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return row, nil
+}
+
+func (m *MemoryRepository) CreateEmployee(ctx context.Context, employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.rows[employee.EmailAddress]; ok {
+		return nil, errors.Errorf("duplicate employee: %q", employee.EmailAddress)
+	}
+	row := &memoryRow{
+		lock: make(chan struct{}, 1),
+		employee: Employee{
+			EmailAddress: employee.EmailAddress,
+			FirstName:    employee.FirstName,
+			LastName:     employee.LastName,
+			Version:      1,
+		},
+	}
+	m.rows[employee.EmailAddress] = row
+	employeeCreated := row.employee
+	return &employeeCreated, nil
+}
+
+func (m *MemoryRepository) ReadEmployee(ctx context.Context, emailAddress string) (*Employee, error) {
+	row, err := m.row(emailAddress)
+	if err != nil {
+		return nil, err
+	}
+	employee, ok := row.read()
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &employee, nil
+}
+
+// update will update the row within the transaction (locking the row)
+func (m *MemoryRepository) update(ctx context.Context, tx *memoryTx, row *memoryRow, employee *Employee) (*Employee, error) {
+	if err := tx.lock(ctx, row); err != nil {
+		return nil, err
+	}
+	employeeRow, ok := tx.read(row)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return tx.update(row, employeeRow, employee), nil
+}
+
+// updateWithVersion will update the row within the transaction (locking
+// the row) only if its version matches the given version
+func (m *MemoryRepository) updateWithVersion(ctx context.Context, tx *memoryTx, row *memoryRow, employee *Employee, version int) (*Employee, error) {
+	if err := tx.lock(ctx, row); err != nil {
+		return nil, err
+	}
+	employeeRow, ok := tx.read(row)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if employeeRow.Version != version {
+		return nil, ErrVersionConflict
+	}
+	return tx.update(row, employeeRow, employee), nil
+}
+
+func (m *MemoryRepository) UpdateEmployee(ctx context.Context, employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	ctx, cancel := withTimeout(ctx, m.timeout)
+	defer cancel()
+	row, err := m.row(employee.EmailAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := sleep(ctx, m.latency); err != nil {
+		return nil, err
+	}
+	tx := &memoryTx{}
+	defer tx.rollback()
+	employeeUpdated, err := m.update(ctx, tx, row, employee)
+	if err != nil {
+		return nil, err
+	}
+	tx.commit()
+	return employeeUpdated, nil
+}
+
+func (m *MemoryRepository) UpdateEmployeeWithLock(ctx context.Context, employee *Employee) (*Employee, *Employee, error) {
+	if employee == nil {
+		return nil, nil, errors.New("employee is nil")
+	}
+	ctx, cancel := withTimeout(ctx, m.timeout)
+	defer cancel()
+	row, err := m.row(employee.EmailAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx := &memoryTx{}
+	defer tx.rollback()
+	if err := tx.lock(ctx, row); err != nil {
+		return nil, nil, err
+	}
+	employeeRead, ok := tx.read(row)
+	if !ok {
+		return nil, nil, sql.ErrNoRows
+	}
+	if err := sleep(ctx, m.latency); err != nil {
+		return nil, nil, err
+	}
+	employeeUpdated, err := m.update(ctx, tx, row, employee)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx.commit()
+	return &employeeRead, employeeUpdated, nil
+}
+
+func (m *MemoryRepository) UpdateEmployeeWithVersion(ctx context.Context, employee *Employee, version int) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	ctx, cancel := withTimeout(ctx, m.timeout)
+	defer cancel()
+	row, err := m.row(employee.EmailAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := sleep(ctx, m.latency); err != nil {
+		return nil, err
+	}
+	tx := &memoryTx{}
+	defer tx.rollback()
+	employeeUpdated, err := m.updateWithVersion(ctx, tx, row, employee, version)
+	if err != nil {
+		return nil, err
+	}
+	tx.commit()
+	return employeeUpdated, nil
+}
+
+// UpdateEmployeeInTransaction will read the employee without locking its
+// row and then update it, like a mysql transaction with the read committed
+// isolation level another transaction can read (and update) the same version
+func (m *MemoryRepository) UpdateEmployeeInTransaction(ctx context.Context, employee *Employee) (*Employee, *Employee, error) {
+	if employee == nil {
+		return nil, nil, errors.New("employee is nil")
+	}
+	ctx, cancel := withTimeout(ctx, m.timeout)
+	defer cancel()
+	row, err := m.row(employee.EmailAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx := &memoryTx{}
+	defer tx.rollback()
+	employeeRead, ok := tx.read(row)
+	if !ok {
+		return nil, nil, sql.ErrNoRows
+	}
+	if err := sleep(ctx, m.latency); err != nil {
+		return nil, nil, err
+	}
+	employeeUpdated, err := m.update(ctx, tx, row, employee)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx.commit()
+	return &employeeRead, employeeUpdated, nil
+}
+
+// DeleteEmployee will delete the employee once no other transaction
+// holds its row lock
+func (m *MemoryRepository) DeleteEmployee(ctx context.Context, emailAddress string) error {
+	ctx, cancel := withTimeout(ctx, m.timeout)
+	defer cancel()
+	row, err := m.row(emailAddress)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	tx := &memoryTx{}
+	defer tx.rollback()
+	if err := tx.lock(ctx, row); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	row.Lock()
+	row.deleted = true
+	row.Unlock()
+	if m.rows[emailAddress] == row {
+		delete(m.rows, emailAddress)
+	}
+	return nil
+}
+
+func (m *MemoryRepository) ListEmployees(ctx context.Context) ([]*Employee, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	employees := make([]*Employee, 0, len(m.rows))
+	for _, row := range m.rows {
+		if employee, ok := row.read(); ok {
+			employees = append(employees, &employee)
+		}
+	}
+	sort.Slice(employees, func(i, j int) bool {
+		return employees[i].EmailAddress < employees[j].EmailAddress
+	})
+	return employees, nil
+}
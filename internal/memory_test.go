@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// newTestMemoryRepository returns a memory repository with the employee
+func newTestMemoryRepository(t *testing.T, latency time.Duration) (*MemoryRepository, *Employee) {
+	t.Helper()
+
+	repository := NewMemoryRepository(latency, time.Second)
+	employee, err := repository.CreateEmployee(context.Background(), newEmployee())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repository, employee
+}
+
+func TestMemoryRepositoryRowLock(t *testing.T) {
+	const latency = 50 * time.Millisecond
+
+	for name, test := range map[string]struct {
+		// update is executed while the row is locked
+		update func(ctx context.Context, r *MemoryRepository, e *Employee) error
+	}{
+		"update_with_lock": {update: func(ctx context.Context, r *MemoryRepository, e *Employee) error {
+			_, _, err := r.UpdateEmployeeWithLock(ctx, e)
+			return err
+		}},
+		"update": {update: func(ctx context.Context, r *MemoryRepository, e *Employee) error {
+			_, err := r.UpdateEmployee(ctx, e)
+			return err
+		}},
+		"update_in_transaction": {update: func(ctx context.Context, r *MemoryRepository, e *Employee) error {
+			_, _, err := r.UpdateEmployeeInTransaction(ctx, e)
+			return err
+		}},
+		"update_with_version": {update: func(ctx context.Context, r *MemoryRepository, e *Employee) error {
+			_, err := r.UpdateEmployeeWithVersion(ctx, e, e.Version+1)
+			return err
+		}},
+		"delete": {update: func(ctx context.Context, r *MemoryRepository, e *Employee) error {
+			return r.DeleteEmployee(ctx, e.EmailAddress)
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			repository, employee := newTestMemoryRepository(t, latency)
+			locked := make(chan struct{})
+			go func() {
+				defer close(locked)
+				if _, _, err := repository.UpdateEmployeeWithLock(context.Background(), employee); err != nil {
+					t.Error(err)
+				}
+			}()
+			time.Sleep(latency / 5)
+
+			// reads don't block, and see the version before the lock
+			// holder commits
+			if employeeRead, err := repository.ReadEmployee(context.Background(), employee.EmailAddress); err != nil {
+				t.Fatal(err)
+			} else if employeeRead.Version != employee.Version {
+				t.Fatalf("expected version %d while locked, got %d", employee.Version, employeeRead.Version)
+			}
+
+			// while the row is locked, the update waits until the context
+			// is done
+			ctx, cancel := context.WithTimeout(context.Background(), latency/5)
+			defer cancel()
+			if err := test.update(ctx, repository, employee); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected the update to block until the deadline, got %v", err)
+			}
+
+			// otherwise it waits for the lock holder to commit
+			tStart := time.Now()
+			if err := test.update(context.Background(), repository, employee); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			default:
+				t.Fatalf("the update didn't wait for the lock holder (waited %s)", time.Since(tStart))
+			case <-locked:
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryVersion(t *testing.T) {
+	repository, employee := newTestMemoryRepository(t, 0)
+	for _, test := range []struct {
+		name    string
+		email   string
+		version int
+		err     error
+		updated int
+	}{
+		{name: "current", version: employee.Version, updated: employee.Version + 1},
+		{name: "stale", version: employee.Version, err: ErrVersionConflict},
+		{name: "future", version: employee.Version + 2, err: ErrVersionConflict},
+		{name: "current_again", version: employee.Version + 1, updated: employee.Version + 2},
+		{name: "zero", version: 0, err: ErrVersionConflict},
+		{name: "not_found", email: "not.found@example.com", version: 1, err: sql.ErrNoRows},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := *employee
+			if test.email != "" {
+				e.EmailAddress = test.email
+			}
+			employeeUpdated, err := repository.UpdateEmployeeWithVersion(context.Background(), &e, test.version)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if err == nil && employeeUpdated.Version != test.updated {
+				t.Fatalf("expected version %d, got %d", test.updated, employeeUpdated.Version)
+			}
+		})
+	}
+
+	// concurrent updates with the same version conflict, only one wins
+	repository, employee = newTestMemoryRepository(t, 20*time.Millisecond)
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = repository.UpdateEmployeeWithVersion(context.Background(), employee, employee.Version)
+		}()
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		switch {
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrVersionConflict):
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one update to succeed, got %d", succeeded)
+	}
+}
+
+func TestMemoryRepositoryLostUpdate(t *testing.T) {
+	// without a mutex, both go routines read the same version before
+	// either updates (the latency is injected before the update) so one
+	// of the updates is lost
+	repository, employee := newTestMemoryRepository(t, 50*time.Millisecond)
+	var wg sync.WaitGroup
+	type mutation struct{ read, updated *Employee }
+	mutations := make([]mutation, 2)
+	for i := range mutations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			employeeRead, err := repository.ReadEmployee(context.Background(), employee.EmailAddress)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			employeeUpdated, err := repository.UpdateEmployee(context.Background(), employee)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutations[i] = mutation{employeeRead, employeeUpdated}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	inconsistencies := 0
+	for _, m := range mutations {
+		if m.read.Version != employee.Version {
+			t.Fatalf("expected both go routines to read version %d, got %d", employee.Version, m.read.Version)
+		}
+		if !versionConsistent(m.read, m.updated) {
+			inconsistencies++
+		}
+	}
+	if inconsistencies != 1 {
+		t.Fatalf("expected one lost update, got %d inconsistencies", inconsistencies)
+	}
+}
+
+func TestMemoryRepositoryScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the scenarios in short mode")
+	}
+	for _, test := range []struct {
+		scenario        string
+		inconsistencies bool
+		retries         bool
+	}{
+		{scenario: "no-mutex", inconsistencies: true},
+		{scenario: "transaction", inconsistencies: true},
+		{scenario: "row-lock"},
+		{scenario: "version"},
+		{scenario: "version-retry", retries: true},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			var scenario Scenario
+
+			for _, s := range Scenarios() {
+				if s.Name() == test.scenario {
+					scenario = s
+				}
+			}
+			if scenario == nil {
+				t.Fatalf("scenario not registered: %q", test.scenario)
+			}
+			config := NewConfiguration()
+			config.EmployeeStore = EmployeeStoreMemory
+			config.MemoryLatency = 2 * time.Millisecond
+			config.GoRoutines = 4
+			config.MutateInterval = time.Millisecond
+			config.DemoDuration = 200 * time.Millisecond
+			repository, employee := newTestMemoryRepository(t, config.MemoryLatency)
+			env := &ScenarioEnvironment{Config: config, Repository: repository, Employee: employee}
+			results, err := runScenario(config, make(chan os.Signal), env, scenario, "benchmark",
+				runOptions{load: LoadClosed, history: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := results[0]
+			if result.Mutations == 0 {
+				t.Fatal("expected mutations")
+			}
+			if (result.Inconsistencies > 0) != test.inconsistencies {
+				t.Fatalf("expected inconsistencies: %t, got %d", test.inconsistencies, result.Inconsistencies)
+			}
+			if (result.Retries > 0) != test.retries {
+				t.Fatalf("expected retries: %t, got %d", test.retries, result.Retries)
+			}
+			if result.Backend != BackendNone {
+				t.Fatalf("expected the backend %q, got %q", BackendNone, result.Backend)
+			}
+			// lost updates (two mutations that replaced the same version)
+			// aren't linearizable, the minimal violation is the lost update
+			linearizability := result.Linearizability
+			if linearizability.Linearizable == test.inconsistencies {
+				t.Fatalf("expected linearizable %t, got %+v", !test.inconsistencies, linearizability)
+			}
+			if test.inconsistencies {
+				violation := linearizability.Violation
+				if len(violation) != 2 || violation[0].Read != violation[1].Read {
+					t.Fatalf("expected a lost update violation, got %+v", violation)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,476 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tableMigrations string = "schema_migrations"
+	migrationsLock  string = "go_blog_distributed_mutex_migrations"
+)
+
+const usageMigrate string = `usage: migrate <command> [flags]
+
+commands:
+ up                           apply all of the pending migrations
+ down                         revert the most recently applied migration(s)
+ status                       show the applied and pending migrations
+
+flags:
+ --store=mysql|sqlite         the employee store to migrate (default: EMPLOYEE_STORE or mysql)
+ --steps=1                    the number of migrations to revert (down)
+ --output=table|json          the format of the status (default: table)
+`
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// Migration is a versioned change to the schema, the checksum is the
+// sha256 of the up script and is used to detect migrations that were
+// modified after they were applied
+type Migration struct {
+	Version  int    `json:"version"`
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+	up       string
+	down     string
+}
+
+// MigrationStatus describes whether or not a migration has been applied,
+// a migration is missing if it was applied but isn't embedded
+type MigrationStatus struct {
+	Migration
+	Applied         bool   `json:"applied"`
+	AppliedAt       string `json:"applied_at,omitempty"`
+	AppliedChecksum string `json:"applied_checksum,omitempty"`
+	Missing         bool   `json:"missing,omitempty"`
+}
+
+// Modified returns true if the migration was modified after it was applied
+func (s *MigrationStatus) Modified() bool {
+	return s.Applied && !s.Missing && s.AppliedChecksum != s.Checksum
+}
+
+// loadMigrations will load the embedded migrations for the dialect (mysql or
+// sqlite), migrations are named <version>_<name>.up.sql and .down.sql
+func loadMigrations(dialect string) ([]*Migration, error) {
+	migrations := make(map[int]*Migration)
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, errors.Errorf("unsupported migration dialect: %q", dialect)
+	}
+	for _, entry := range entries {
+		name, direction := entry.Name(), ""
+		switch {
+		default:
+			return nil, errors.Errorf("unexpected migration file: %q", name)
+		case strings.HasSuffix(name, ".up.sql"):
+			name, direction = strings.TrimSuffix(name, ".up.sql"), "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			name, direction = strings.TrimSuffix(name, ".down.sql"), "down"
+		}
+		s := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(s[0])
+		if err != nil || len(s) != 2 || version <= 0 {
+			return nil, errors.Errorf("unexpected migration file: %q", entry.Name())
+		}
+		bytes, err := migrationsFS.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := migrations[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: s[1]}
+			migrations[version] = migration
+		}
+		if migration.Name != s[1] {
+			return nil, errors.Errorf("migration %04d has more than one name", version)
+		}
+		switch direction {
+		case "up":
+			checksum := sha256.Sum256(bytes)
+			migration.up, migration.Checksum = string(bytes), hex.EncodeToString(checksum[:])
+		case "down":
+			migration.down = string(bytes)
+		}
+	}
+	var sorted []*Migration
+	for _, migration := range migrations {
+		if migration.up == "" || migration.down == "" {
+			return nil, errors.Errorf("migration %04d (%s) requires an up and a down script",
+				migration.Version, migration.Name)
+		}
+		sorted = append(sorted, migration)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return sorted, nil
+}
+
+// Migrator applies and reverts the embedded migrations, the applied
+// migrations are recorded in the schema_migrations table
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []*Migration
+}
+
+func NewMigrator(db *sql.DB, dialect string) (*Migrator, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		dialect:    dialect,
+		migrations: migrations,
+	}, nil
+}
+
+// locked will execute the function while holding the migrations lock such
+// that multiple processes can't migrate at the same time; for mysql this is
+// a named lock, for sqlite the function is executed within a transaction
+// started with BEGIN IMMEDIATE (sqlite supports transactional ddl)
+func (m *Migrator) locked(ctx context.Context, fx func(conn *sql.Conn) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	createTable := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+    version INT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    applied_at VARCHAR(64) NOT NULL,
+    PRIMARY KEY (version)
+);`, tableMigrations)
+	switch m.dialect {
+	default:
+		return errors.Errorf("unsupported migration dialect: %q", m.dialect)
+	case EmployeeStoreMysql:
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?);",
+			migrationsLock, 60).Scan(&locked); err != nil {
+			return err
+		}
+		if locked.Int64 != 1 {
+			return errors.New("timed out waiting for the migrations lock")
+		}
+		defer func() {
+			_, _ = conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?);", migrationsLock)
+		}()
+		if _, err := conn.ExecContext(ctx, createTable); err != nil {
+			return err
+		}
+		return fx(conn)
+	case EmployeeStoreSqlite:
+		if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE;"); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				_, _ = conn.ExecContext(context.Background(), "ROLLBACK;")
+			}
+		}()
+		if _, err := conn.ExecContext(ctx, createTable); err != nil {
+			return err
+		}
+		if err := fx(conn); err != nil {
+			return err
+		}
+		_, err = conn.ExecContext(ctx, "COMMIT;")
+		return err
+	}
+}
+
+// status will read the applied migrations and compare them with the
+// embedded migrations
+func (m *Migrator) status(ctx context.Context, conn *sql.Conn) ([]*MigrationStatus, error) {
+	var statuses []*MigrationStatus
+
+	query := fmt.Sprintf("SELECT version, name, checksum, applied_at FROM %s ORDER BY version;", tableMigrations)
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]*MigrationStatus)
+	for rows.Next() {
+		status := &MigrationStatus{Applied: true}
+		if err := rows.Scan(&status.Version, &status.Name,
+			&status.AppliedChecksum, &status.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[status.Version] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, migration := range m.migrations {
+		status := &MigrationStatus{Migration: *migration}
+		if a, ok := applied[migration.Version]; ok {
+			status.Applied, status.AppliedAt, status.AppliedChecksum = true, a.AppliedAt, a.AppliedChecksum
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, status := range applied {
+		status.Missing, status.Checksum = true, status.AppliedChecksum
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// verify will return an error if any of the applied migrations were
+// modified after they were applied
+func verify(statuses []*MigrationStatus) error {
+	for _, status := range statuses {
+		if status.Modified() {
+			return errors.Errorf("migration %04d (%s) was modified after it was applied (checksum %s, applied %s)",
+				status.Version, status.Name, status.Checksum, status.AppliedChecksum)
+		}
+	}
+	return nil
+}
+
+// exec will execute the script as is, the script may contain multiple
+// statements (the mysql connection must be opened with multiStatements)
+func (m *Migrator) exec(ctx context.Context, conn *sql.Conn, script string) error {
+	_, err := conn.ExecContext(ctx, script)
+	return err
+}
+
+// Status returns the status of each migration
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationStatus, error) {
+	var statuses []*MigrationStatus
+
+	err := m.locked(ctx, func(conn *sql.Conn) (err error) {
+		statuses, err = m.status(ctx, conn)
+		return err
+	})
+	return statuses, err
+}
+
+// Up will apply all of the pending migrations (in order), it returns the
+// migrations that were applied
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	var applied []*Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		statuses, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := verify(statuses); err != nil {
+			return err
+		}
+		query := fmt.Sprintf("INSERT INTO %s (version, name, checksum, applied_at) VALUES (?, ?, ?, ?);", tableMigrations)
+		for _, status := range statuses {
+			if status.Applied {
+				continue
+			}
+			if err := m.exec(ctx, conn, status.up); err != nil {
+				return errors.Wrapf(err, "migration %04d (%s)", status.Version, status.Name)
+			}
+			if _, err := conn.ExecContext(ctx, query, status.Version, status.Name,
+				status.Checksum, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+				return err
+			}
+			applied = append(applied, &status.Migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down will revert the given number of migrations (most recently applied
+// first), it returns the migrations that were reverted
+func (m *Migrator) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	var reverted []*Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		statuses, err := m.status(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := verify(statuses); err != nil {
+			return err
+		}
+		query := fmt.Sprintf("DELETE FROM %s WHERE version = ?;", tableMigrations)
+		for i := len(statuses) - 1; i >= 0 && len(reverted) < steps; i-- {
+			status := statuses[i]
+			if !status.Applied {
+				continue
+			}
+			if status.Missing {
+				return errors.Errorf("migration %04d (%s) can't be reverted, it's missing",
+					status.Version, status.Name)
+			}
+			if err := m.exec(ctx, conn, status.down); err != nil {
+				return errors.Wrapf(err, "migration %04d (%s)", status.Version, status.Name)
+			}
+			if _, err := conn.ExecContext(ctx, query, status.Version); err != nil {
+				return err
+			}
+			reverted = append(reverted, &status.Migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// autoMigrate will apply the pending migrations if configured to migrate
+// at startup
+func autoMigrate(config *Configuration, db *sql.DB, dialect string) error {
+	if !config.AutoMigrate {
+		return nil
+	}
+	migrator, err := NewMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		return errors.Wrap(err, "unable to migrate")
+	}
+	return nil
+}
+
+func printMigrations(output string, statuses []*MigrationStatus) error {
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", " ")
+		return encoder.Encode(statuses)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, status := range statuses {
+			state := "pending"
+			switch {
+			case status.Missing:
+				state = "missing"
+			case status.Modified():
+				state = "modified"
+			case status.Applied:
+				state = "applied"
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", status.Version, status.Name, state, status.AppliedAt)
+		}
+		return w.Flush()
+	}
+}
+
+func mainMigrate(config *Configuration, args []string) error {
+	var store, output string
+	var steps int
+
+	if len(args) == 0 {
+		fmt.Print(usageMigrate)
+		return errors.New("migrate requires a command")
+	}
+	command := args[0]
+	switch command {
+	default:
+		fmt.Print(usageMigrate)
+		return errors.Errorf("unsupported command: %q", command)
+	case "up", "down", "status":
+	}
+	store = EmployeeStoreMysql
+	if config.EmployeeStore == EmployeeStoreSqlite {
+		store = EmployeeStoreSqlite
+	}
+	flagSet := flag.NewFlagSet("migrate "+command, flag.ContinueOnError)
+	flagSet.StringVar(&store, "store", store, "the employee store to migrate (mysql or sqlite)")
+	flagSet.IntVar(&steps, "steps", 1, "the number of migrations to revert (down)")
+	flagSet.StringVar(&output, "output", "table", "the format of the status (table or json)")
+	if err := flagSet.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if steps <= 0 {
+		return errors.New("steps must be positive")
+	}
+	// the migrate command shouldn't apply migrations when connecting
+	c := *config
+	c.AutoMigrate = false
+	var db *sql.DB
+	var err error
+	switch store {
+	default:
+		return errors.Errorf("unsupported store: %q (mysql or sqlite)", store)
+	case EmployeeStoreMysql:
+		db, err = newMysql(&c, true)
+	case EmployeeStoreSqlite:
+		db, err = newSqlite(&c)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			fmt.Printf("error occured while closing the database: \"%s\"\n", err)
+		}
+	}()
+	migrator, err := NewMigrator(db, store)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	switch command {
+	case "up":
+		migrations, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			fmt.Printf("applied %04d (%s)\n", migration.Version, migration.Name)
+		}
+		if len(migrations) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		migrations, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			fmt.Printf("reverted %04d (%s)\n", migration.Version, migration.Name)
+		}
+		if len(migrations) == 0 {
+			fmt.Println("no applied migrations")
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return printMigrations(output, statuses)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigratorExec(t *testing.T) {
+	config := NewConfiguration()
+	config.SqliteFile = filepath.Join(t.TempDir(), "exec.db")
+	db, err := newSqlite(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrator, err := NewMigrator(db, EmployeeStoreSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the name of the test is the name of the table
+	for name, test := range map[string]struct {
+		script string
+		value  string
+	}{
+		"multiple": {
+			script: "-- create the table\nCREATE TABLE %[1]s (v TEXT);\n\nINSERT INTO %[1]s VALUES ('a');\n",
+			value:  "a",
+		},
+		"line_ending_in_semicolon": {
+			script: "CREATE TABLE %[1]s (v TEXT);\nINSERT INTO %[1]s VALUES ('a;\nb');",
+			value:  "a;\nb",
+		},
+		"compound": {
+			script: `CREATE TABLE %[1]s (v TEXT);
+CREATE TRIGGER %[1]s_insert AFTER INSERT ON %[1]s BEGIN
+    UPDATE %[1]s SET v = v || 'b';
+END;
+INSERT INTO %[1]s VALUES ('a');`,
+			value: "ab",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := migrator.exec(ctx, conn, fmt.Sprintf(test.script, name)); err != nil {
+				t.Fatal(err)
+			}
+			var value string
+			if err := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT v FROM %s;", name)).Scan(&value); err != nil {
+				t.Fatal(err)
+			}
+			if value != test.value {
+				t.Fatalf("expected %q, got %q", test.value, value)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	migration := Migration{Version: 1, Name: "employees", Checksum: "a"}
+	for name, test := range map[string]struct {
+		status   MigrationStatus
+		modified bool
+	}{
+		"pending":  {status: MigrationStatus{Migration: migration}},
+		"applied":  {status: MigrationStatus{Migration: migration, Applied: true, AppliedChecksum: "a"}},
+		"modified": {status: MigrationStatus{Migration: migration, Applied: true, AppliedChecksum: "b"}, modified: true},
+		"missing": {status: MigrationStatus{Migration: Migration{Version: 2, Name: "removed", Checksum: "b"},
+			Applied: true, AppliedChecksum: "b", Missing: true}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if modified := test.status.Modified(); modified != test.modified {
+				t.Fatalf("expected modified %t, got %t", test.modified, modified)
+			}
+			if err := verify([]*MigrationStatus{&test.status}); (err != nil) != test.modified {
+				t.Fatalf("expected an error: %t, got %v", test.modified, err)
+			}
+		})
+	}
+}
+
+func TestMigratorChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	config := NewConfiguration()
+	config.SqliteFile = filepath.Join(t.TempDir(), "migrate.db")
+	db, err := newSqlite(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrator, err := NewMigrator(db, EmployeeStoreSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrator.migrations) {
+		t.Fatalf("expected %d migrations to be applied, got %d", len(migrator.migrations), len(applied))
+	}
+	if applied, err := migrator.Up(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("expected no pending migrations, got %d: %v", len(applied), err)
+	}
+
+	// modifying the applied checksum is the same as modifying the migration
+	// after it was applied
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET checksum = ? WHERE version = ?;",
+		tableMigrations), "modified", migrator.migrations[0].Version); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[0].Modified() {
+		t.Fatalf("expected migration %04d to be modified", statuses[0].Version)
+	}
+	if _, err := migrator.Up(ctx); err == nil || !strings.Contains(err.Error(), "was modified") {
+		t.Fatalf("expected up to fail with a checksum mismatch, got %v", err)
+	}
+	if _, err := migrator.Down(ctx, 1); err == nil || !strings.Contains(err.Error(), "was modified") {
+		t.Fatalf("expected down to fail with a checksum mismatch, got %v", err)
+	}
+}
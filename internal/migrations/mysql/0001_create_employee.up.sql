@@ -1,9 +1,3 @@
--- DROP DATABASE IF EXISTS go_blog_distributed_mutex
-CREATE DATABASE IF NOT EXISTS go_blog_distributed_mutex;
-
-USE go_blog_distributed_mutex;
-
--- DROP TABLE IF EXISTS employee
 CREATE TABLE IF NOT EXISTS employee (
     email_address TEXT NOT NULL,
     first_name TEXT,
@@ -11,4 +5,3 @@ CREATE TABLE IF NOT EXISTS employee (
     version INT NOT NULL DEFAULT 1,
     PRIMARY KEY (email_address(255))
 ) ENGINE = InnoDB;
-
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS employee (
+    email_address TEXT NOT NULL PRIMARY KEY,
+    first_name TEXT,
+    last_name TEXT,
+    version INTEGER NOT NULL DEFAULT 1
+);
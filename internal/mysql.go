@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// mysqlRowLock is a row lock held by a transaction along with the
+// connection (i.e., the thread) the transaction belongs to
+type mysqlRowLock struct {
+	*LockInfo
+	connectionID int64
+}
+
+// MysqlLockAdmin can be used to administrate the row locks (e.g., SELECT
+// ... FOR UPDATE) held on the employee table; a lock is named after the
+// primary key of the row (the email address), the owner is the connection
+// of the transaction holding it and the token is the transaction id. Innodb
+// only reports row locks that someone is waiting for, so uncontended row
+// locks aren't listed
+type MysqlLockAdmin struct {
+	db *sql.DB
+}
+
+func NewMysqlLockAdmin(config *Configuration) (*MysqlLockAdmin, error) {
+	db, err := NewSql(config)
+	if err != nil {
+		return nil, err
+	}
+	return &MysqlLockAdmin{db: db}, nil
+}
+
+func (m *MysqlLockAdmin) Close() error {
+	return m.db.Close()
+}
+
+// rowLocks will return the row locks (held on the employee table) that
+// someone is waiting for
+func (m *MysqlLockAdmin) rowLocks(ctx context.Context) ([]*mysqlRowLock, error) {
+	query := "SELECT l.lock_data, l.lock_trx_id, t.trx_mysql_thread_id, COALESCE(p.user, ''), COALESCE(p.host, ''), COUNT(*) " +
+		"FROM information_schema.innodb_lock_waits w " +
+		"JOIN information_schema.innodb_locks l ON l.lock_id = w.blocking_lock_id " +
+		"JOIN information_schema.innodb_trx t ON t.trx_id = l.lock_trx_id " +
+		"LEFT JOIN information_schema.processlist p ON p.id = t.trx_mysql_thread_id " +
+		"WHERE l.lock_type = 'RECORD' AND l.lock_table = CONCAT('`', DATABASE(), '`.`', ?, '`') " +
+		"GROUP BY l.lock_id, l.lock_data, l.lock_trx_id, t.trx_mysql_thread_id, p.user, p.host " +
+		"ORDER BY l.lock_data;"
+	rows, err := m.db.QueryContext(ctx, query, tableEmployee)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var locks []*mysqlRowLock
+	for rows.Next() {
+		var lockData sql.NullString
+		var user, host string
+
+		lock := &mysqlRowLock{LockInfo: &LockInfo{}}
+		if err := rows.Scan(
+			&lockData,
+			&lock.Token,
+			&lock.connectionID,
+			&user,
+			&host,
+			&lock.Waiters,
+		); err != nil {
+			return nil, err
+		}
+		// the lock data is the primary key as a quoted string (it can be
+		// null if the page holding the row isn't in the buffer pool)
+		lock.Name = strings.TrimSuffix(strings.TrimPrefix(lockData.String, "'"), "'")
+		lock.Owner = fmt.Sprintf("%s@%s (connection %d)", user, host, lock.connectionID)
+		locks = append(locks, lock)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+func (m *MysqlLockAdmin) List(ctx context.Context) ([]*LockInfo, error) {
+	rowLocks, err := m.rowLocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	locks := make([]*LockInfo, 0, len(rowLocks))
+	for _, lock := range rowLocks {
+		locks = append(locks, lock.LockInfo)
+	}
+	return locks, nil
+}
+
+func (m *MysqlLockAdmin) Show(ctx context.Context, name string) (*LockInfo, error) {
+	rowLocks, err := m.rowLocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, lock := range rowLocks {
+		if lock.Name == name {
+			return lock.LockInfo, nil
+		}
+	}
+	return nil, ErrLockNotFound
+}
+
+// ForceRelease will kill the connection(s) holding the row lock, killing
+// the connection rolls back its transaction which releases the lock
+func (m *MysqlLockAdmin) ForceRelease(ctx context.Context, name string) error {
+	rowLocks, err := m.rowLocks(ctx)
+	if err != nil {
+		return err
+	}
+	killed := make(map[int64]bool)
+	for _, lock := range rowLocks {
+		if lock.Name != name || killed[lock.connectionID] {
+			continue
+		}
+		if _, err := m.db.ExecContext(ctx, fmt.Sprintf("KILL %d;", lock.connectionID)); err != nil {
+			return err
+		}
+		killed[lock.connectionID] = true
+	}
+	if len(killed) == 0 {
+		return ErrLockNotFound
+	}
+	return nil
+}
+
+// SetTTL isn't supported, row locks don't expire; they're held until the
+// transaction holding them is committed or rolled back
+func (m *MysqlLockAdmin) SetTTL(ctx context.Context, name string, ttl time.Duration) error {
+	return errors.New("ttl unsupported; mysql row locks are held until the transaction ends")
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpProxy is a local tcp proxy that forwards connections to a target
+// address, it can sever all connections (and refuse new ones) to simulate
+// a network partition
+type tcpProxy struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	listener net.Listener
+	target   string
+	severed  bool
+	conns    map[net.Conn]struct{}
+}
+
+func newTCPProxy(target string) (*tcpProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &tcpProxy{
+		listener: listener,
+		target:   target,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.accept()
+	}()
+	return p, nil
+}
+
+func (p *tcpProxy) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.Lock()
+		severed := p.severed
+		p.Unlock()
+		if severed {
+			conn.Close()
+			continue
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.forward(conn)
+		}()
+	}
+}
+
+func (p *tcpProxy) forward(conn net.Conn) {
+	target, err := net.DialTimeout("tcp", p.target, 5*time.Second)
+	if err != nil {
+		fmt.Printf("error occured while connecting to %s: \"%s\"\n", p.target, err)
+		conn.Close()
+		return
+	}
+	p.Lock()
+	p.conns[conn], p.conns[target] = struct{}{}, struct{}{}
+	p.Unlock()
+	defer func() {
+		p.Lock()
+		delete(p.conns, conn)
+		delete(p.conns, target)
+		p.Unlock()
+	}()
+	done := make(chan struct{}, 2)
+	copyFx := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyFx(target, conn)
+	go copyFx(conn, target)
+	<-done
+	conn.Close()
+	target.Close()
+	<-done
+}
+
+// Address returns the address the proxy is listening on
+func (p *tcpProxy) Address() string {
+	return p.listener.Addr().String()
+}
+
+// Sever will close all of the proxied connections, new connections
+// will be closed as soon as they're accepted until Restore is called
+func (p *tcpProxy) Sever() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.severed = true
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// Restore will allow new connections to be proxied
+func (p *tcpProxy) Restore() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.severed = false
+}
+
+// Close will stop the proxy and close all of the proxied connections
+func (p *tcpProxy) Close() error {
+	err := p.listener.Close()
+	p.Sever()
+	p.wg.Wait()
+	return err
+}
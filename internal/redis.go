@@ -3,21 +3,218 @@ package internal
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	redis "github.com/redis/go-redis/v9"
 )
 
 const hashKeyRedisMutex = "redis_mutex"
 
+// redisLockScript will attempt to set the lock (if it doesn't exist)
+// and its owner, if unable to lock, the token will be registered as a
+// waiter until the given waiter expiration
+var redisLockScript = redis.NewScript(`
+	local key, owner_key, waiters_key = KEYS[1], KEYS[2], KEYS[3]
+	local token, owner = ARGV[1], ARGV[2]
+	local expiration, waiter_expiration = tonumber(ARGV[3]), tonumber(ARGV[4])
+	local time = redis.call('TIME')
+	local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+	redis.call('ZREMRANGEBYSCORE', waiters_key, '-inf', now)
+	if redis.call('SET', key, token, 'NX', 'PX', expiration) then
+		redis.call('SET', owner_key, owner, 'PX', expiration)
+		redis.call('ZREM', waiters_key, token)
+		return 1
+	end
+	redis.call('ZADD', waiters_key, now + waiter_expiration, token)
+	redis.call('PEXPIRE', waiters_key, waiter_expiration)
+	return 0
+`)
+
+// redisUnlockScript will delete the lock and its owner only if the
+// lock is held with the given token
+var redisUnlockScript = redis.NewScript(`
+	local key, owner_key = KEYS[1], KEYS[2]
+	local token = ARGV[1]
+
+	if redis.call('GET', key) == token then
+		redis.call('DEL', owner_key)
+		return redis.call('DEL', key)
+	end
+	return 0 -- Key not deleted (value did not match)
+`)
+
+// redisRenewScript will set the time to live for the lock and its
+// owner only if the lock is held with the given token
+var redisRenewScript = redis.NewScript(`
+	local key, owner_key = KEYS[1], KEYS[2]
+	local token, expiration = ARGV[1], tonumber(ARGV[2])
+
+	if redis.call('GET', key) == token then
+		redis.call('PEXPIRE', owner_key, expiration)
+		return redis.call('PEXPIRE', key, expiration)
+	end
+	return 0
+`)
+
+// redisExpireScript will set the time to live for the lock and its
+// owner if the lock exists
+var redisExpireScript = redis.NewScript(`
+	local key, owner_key = KEYS[1], KEYS[2]
+	local expiration = tonumber(ARGV[1])
+
+	if redis.call('PEXPIRE', key, expiration) == 1 then
+		redis.call('PEXPIRE', owner_key, expiration)
+		return 1
+	end
+	return 0
+`)
+
+// redisKey can be used to generate a key wrapped in a hash tag, in cluster
+// mode only the content of the hash tag is used to determine the slot so
+// that any keys that share the same name will live on the same node; this
+// is required for scripts that operate on more than one key
+func redisKey(name string, suffixes ...string) string {
+	return strings.Join(append([]string{"{" + name + "}"}, suffixes...), ":")
+}
+
+// redisMutexKeys can be used to generate the keys for the lock, the
+// owner and the waiters of the named redis mutex
+func redisMutexKeys(name string) []string {
+	return []string{
+		redisKey(hashKeyRedisMutex + ":" + name),
+		redisKey(hashKeyRedisMutex+":"+name, "owner"),
+		redisKey(hashKeyRedisMutex+":"+name, "waiters"),
+	}
+}
+
+// redisTryLock will attempt to lock the mutex with the given keys, if
+// unable to, the token will be registered as a waiter until the next
+// attempt (i.e., the retry interval) has passed
+func redisTryLock(ctx context.Context, redisClient redis.UniversalClient, keys []string,
+	token, owner string, expiration, retryInterval time.Duration) (bool, error) {
+	result, err := redisLockScript.Run(ctx, redisClient, keys,
+		token, owner, expiration.Milliseconds(),
+		(expiration + retryInterval).Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// redisScan can be used to scan for keys that match the given pattern,
+// in cluster mode, each master will be scanned
+func redisScan(ctx context.Context, redisClient redis.UniversalClient, pattern string) ([]string, error) {
+	var mu sync.Mutex
+	var keys []string
+
+	scanFx := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 0).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+	if clusterClient, ok := redisClient.(*redis.ClusterClient); ok {
+		if err := clusterClient.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scanFx(ctx, client)
+		}); err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}
+	if err := scanFx(ctx, redisClient); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// newRedisClient can be used to create a redis client for the configured
+// redis mode; standalone connects to a single address, sentinel discovers
+// the master (by name) through the sentinel addresses and cluster uses
+// the addresses as seeds to discover the cluster topology
+func newRedisClient(config *Configuration) (redis.UniversalClient, error) {
+	options := &redis.UniversalOptions{
+		SentinelPassword: config.RedisSentinelPassword,
+	}
+	if config.RedisUsernameFile == "" && config.RedisPasswordFile == "" {
+		options.Username = config.RedisUsername
+		options.Password = config.RedisPassword
+	} else {
+		// credentials are read each time a connection is created so
+		// they can be rotated without restarting the application
+		options.CredentialsProviderContext = func(context.Context) (string, string, error) {
+			username, err := readCredential(config.RedisUsername, config.RedisUsernameFile)
+			if err != nil {
+				return "", "", err
+			}
+			password, err := readCredential(config.RedisPassword, config.RedisPasswordFile)
+			if err != nil {
+				return "", "", err
+			}
+			return username, password, nil
+		}
+		if _, _, err := options.CredentialsProviderContext(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	if config.RedisTLS {
+		tlsConfig, err := newTLSConfig(config.RedisTLSCAFile, config.RedisTLSCertFile,
+			config.RedisTLSKeyFile, config.RedisTLSServerName, config.RedisTLSSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = tlsConfig
+	}
+	switch config.RedisMode {
+	default:
+		return nil, errors.Errorf("unsupported redis mode: %q", config.RedisMode)
+	case "", RedisModeStandalone:
+		address := config.RedisHost
+		if config.RedisPort != "" {
+			address = address + ":" + config.RedisPort
+		}
+		options.Addrs = []string{address}
+		options.DB = config.RedisDatabase
+	case RedisModeSentinel:
+		if config.RedisMasterName == "" {
+			return nil, errors.New("redis master name is required for sentinel mode")
+		}
+		if len(config.RedisAddresses) == 0 {
+			return nil, errors.New("redis addresses are required for sentinel mode")
+		}
+		options.Addrs = config.RedisAddresses
+		options.MasterName = config.RedisMasterName
+		options.DB = config.RedisDatabase
+	case RedisModeCluster:
+		if len(config.RedisAddresses) == 0 {
+			return nil, errors.New("redis addresses are required for cluster mode")
+		}
+		options.Addrs = config.RedisAddresses
+		options.IsClusterMode = true
+	}
+	return redis.NewUniversalClient(options), nil
+}
+
 type RedisMutex struct {
+	mu     sync.Mutex
+	held   sync.Mutex
 	config struct {
 		retryInterval   time.Duration
 		mutexExpiration time.Duration
 	}
 	ctx          context.Context
 	cancel       context.CancelFunc
-	redisClient  *redis.Client
+	keys         []string
+	owner        string
+	token        string
+	redisClient  redis.UniversalClient
 	errorHandler func(error)
 }
 
@@ -27,21 +224,18 @@ func NewRedisMutex(config *Configuration) (*RedisMutex, error) {
 			fmt.Printf("redis error: %s\n", err.Error())
 		},
 	}
-	address := config.RedisHost
-	if config.RedisPort != "" {
-		address = address + ":" + config.RedisPort
+	redisClient, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
 	}
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     address,
-		Username: config.RedisUsername,
-		Password: config.RedisPassword,
-		DB:       config.RedisDatabase,
-	})
 	ctx, cancel := context.WithCancel(context.Background())
 	if err := redisClient.Ping(ctx).Err(); err != nil {
 		cancel()
+		redisClient.Close()
 		return nil, err
 	}
+	r.keys = redisMutexKeys(config.MutexName)
+	r.owner = GenerateOwner()
 	r.ctx, r.cancel = ctx, cancel
 	r.redisClient = redisClient
 	r.config.mutexExpiration = config.MutexExpiration
@@ -54,21 +248,22 @@ func (r *RedisMutex) Close() error {
 	return r.redisClient.Close()
 }
 
-func (r *RedisMutex) Lock() {
+// LockToken will block until the mutex is locked and return the token that
+// identifies the acquisition; the token must be used to unlock the mutex
+// (see UnlockToken) so go routines sharing the mutex keep their own token
+// and a holder whose lock expired can't unlock someone else's lock
+func (r *RedisMutex) LockToken() string {
+	token := GenerateID()
 	lockFx := func() (bool, error) {
-		result, err := r.redisClient.SetNX(r.ctx,
-			hashKeyRedisMutex, true, r.config.mutexExpiration).Result()
-		if err != nil {
-			return false, err
-		}
-		return result, nil
+		return redisTryLock(r.ctx, r.redisClient, r.keys, token, r.owner,
+			r.config.mutexExpiration, r.config.retryInterval)
 	}
 	locked, err := lockFx()
 	if err != nil {
 		r.errorHandler(err)
 	}
 	if locked {
-		return
+		return token
 	}
 	tRetry := time.NewTicker(r.config.retryInterval)
 	defer tRetry.Stop()
@@ -79,43 +274,21 @@ func (r *RedisMutex) Lock() {
 			continue
 		}
 		if locked {
-			return
+			return token
 		}
 	}
 }
 
-func (r *RedisMutex) Reset() error {
-	_, err := r.redisClient.Del(r.ctx,
-		hashKeyRedisMutex).Result()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (r *RedisMutex) Unlock() {
+// UnlockToken will unlock the mutex if it's held by the given token, it
+// panics if it isn't (e.g., the lock expired and was acquired by someone
+// else)
+func (r *RedisMutex) UnlockToken(token string) {
 	unlockFx := func() (bool, error) {
-		script := `
-			local key = KEYS[1]
-			local expected_value = ARGV[1]
-
-			local current_value = redis.call('GET', key)
-
-			if current_value == expected_value then
-			    return redis.call('DEL', key)
-			else
-		    	return 0 -- Key not deleted (value did not match)
-			end
-		`
-		item, err := r.redisClient.Eval(r.ctx, script,
-			[]string{hashKeyRedisMutex}, true).Result()
+		i, err := redisUnlockScript.Run(r.ctx, r.redisClient,
+			r.keys[:2], token).Int()
 		if err != nil {
 			return false, err
 		}
-		i, ok := item.(int64)
-		if !ok {
-			return false, nil
-		}
 		return i == 1, nil
 	}
 	unlocked, err := unlockFx()
@@ -141,3 +314,165 @@ func (r *RedisMutex) Unlock() {
 		return
 	}
 }
+
+// Lock will lock the mutex, the token is kept by the mutex so only one go
+// routine can hold it (using Lock) at a time, even if the lock expires;
+// go routines that share the mutex should use LockToken
+func (r *RedisMutex) Lock() {
+	r.held.Lock()
+	token := r.LockToken()
+	r.mu.Lock()
+	r.token = token
+	r.mu.Unlock()
+}
+
+func (r *RedisMutex) Unlock() {
+	r.mu.Lock()
+	token := r.token
+	r.token = ""
+	r.mu.Unlock()
+	if token == "" {
+		panic("attempted to unlock an unlocked mutex")
+	}
+	defer r.held.Unlock()
+	r.UnlockToken(token)
+}
+
+func (r *RedisMutex) Reset() error {
+	_, err := r.redisClient.Del(r.ctx,
+		r.keys...).Result()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RedisLocker can be used to acquire locks on behalf of others and to
+// administrate the locks created by RedisMutex
+type RedisLocker struct {
+	config struct {
+		retryInterval time.Duration
+	}
+	redisClient redis.UniversalClient
+}
+
+func NewRedisLocker(config *Configuration) (*RedisLocker, error) {
+	redisClient, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+	r := &RedisLocker{redisClient: redisClient}
+	r.config.retryInterval = config.RetryInterval
+	return r, nil
+}
+
+func (r *RedisLocker) Close() error {
+	return r.redisClient.Close()
+}
+
+func (r *RedisLocker) List(ctx context.Context) ([]*LockInfo, error) {
+	keys, err := redisScan(ctx, r.redisClient, redisKey(hashKeyRedisMutex+":*"))
+	if err != nil {
+		return nil, err
+	}
+	locks := make([]*LockInfo, 0, len(keys))
+	for _, key := range keys {
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "{"+hashKeyRedisMutex+":"), "}")
+		lock, err := r.Show(ctx, name)
+		switch {
+		case errors.Is(err, ErrLockNotFound):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+func (r *RedisLocker) Show(ctx context.Context, name string) (*LockInfo, error) {
+	keys := redisMutexKeys(name)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	pipeline := r.redisClient.Pipeline()
+	token := pipeline.Get(ctx, keys[0])
+	owner := pipeline.Get(ctx, keys[1])
+	ttl := pipeline.PTTL(ctx, keys[0])
+	waiters := pipeline.ZCount(ctx, keys[2], now, "+inf")
+	if _, err := pipeline.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if errors.Is(token.Err(), redis.Nil) {
+		return nil, ErrLockNotFound
+	}
+	return &LockInfo{
+		Name:    name,
+		Owner:   owner.Val(),
+		Token:   token.Val(),
+		TTL:     ttl.Val(),
+		Waiters: int(waiters.Val()),
+	}, nil
+}
+
+func (r *RedisLocker) ForceRelease(ctx context.Context, name string) error {
+	n, err := r.redisClient.Del(ctx, redisMutexKeys(name)[:2]...).Result()
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return ErrLockNotFound
+	}
+	return nil
+}
+
+func (r *RedisLocker) SetTTL(ctx context.Context, name string, ttl time.Duration) error {
+	i, err := redisExpireScript.Run(ctx, r.redisClient,
+		redisMutexKeys(name)[:2], ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if i != 1 {
+		return ErrLockNotFound
+	}
+	return nil
+}
+
+func (r *RedisLocker) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (string, error) {
+	keys, token := redisMutexKeys(name), GenerateID()
+	if err := acquire(ctx, r.config.retryInterval, func() (bool, error) {
+		return redisTryLock(ctx, r.redisClient, keys, token, owner,
+			ttl, r.config.retryInterval)
+	}, func() error {
+		return r.redisClient.ZRem(context.Background(), keys[2], token).Err()
+	}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (r *RedisLocker) Renew(ctx context.Context, name, token string, ttl time.Duration) error {
+	i, err := redisRenewScript.Run(ctx, r.redisClient,
+		redisMutexKeys(name)[:2], token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if i != 1 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+func (r *RedisLocker) Release(ctx context.Context, name, token string) error {
+	i, err := redisUnlockScript.Run(ctx, r.redisClient,
+		redisMutexKeys(name)[:2], token).Int()
+	if err != nil {
+		return err
+	}
+	if i != 1 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
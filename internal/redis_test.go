@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+const sentinelMasterName string = "go_blog_distributed_mutex"
+
+// freePort returns a port that's free (at the time it's returned)
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// startProcess starts the process and kills it once the test is done
+func startProcess(t *testing.T, name string, args ...string) *exec.Cmd {
+	t.Helper()
+
+	cmd := exec.Command(name, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	return cmd
+}
+
+// waitFor polls the function until it succeeds or the timeout elapses
+func waitFor(t *testing.T, timeout time.Duration, fx func() error) {
+	t.Helper()
+
+	var err error
+	for tStop := time.Now().Add(timeout); time.Now().Before(tStop); time.Sleep(50 * time.Millisecond) {
+		if err = fx(); err == nil {
+			return
+		}
+	}
+	t.Fatalf("timed out after %s: %s", timeout, err)
+}
+
+func pingRedis(address string) error {
+	client := redis.NewClient(&redis.Options{Addr: address})
+	defer client.Close()
+	return client.Ping(context.Background()).Err()
+}
+
+// sentinelMaster returns the address of the master as known by the sentinel
+func sentinelMaster(address string) (string, error) {
+	client := redis.NewSentinelClient(&redis.Options{Addr: address})
+	defer client.Close()
+	master, err := client.GetMasterAddrByName(context.Background(), sentinelMasterName).Result()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(master[0], master[1]), nil
+}
+
+// TestRedisMutexSentinelFailover documents how the redis mutex behaves when
+// the master fails over: a lock that was replicated before the master was
+// killed is still held once the replica is promoted (so it can be unlocked
+// with its token) and new locks are acquired from the new master once the
+// client has discovered it through the sentinel. It starts local
+// redis-server and redis-sentinel processes so it only runs if
+// REDIS_FAILOVER_TEST is set
+func TestRedisMutexSentinelFailover(t *testing.T) {
+	if os.Getenv("REDIS_FAILOVER_TEST") == "" {
+		t.Skip("set REDIS_FAILOVER_TEST to run the failover test (requires redis-server and redis-sentinel)")
+	}
+	for _, name := range []string{"redis-server", "redis-sentinel"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Fatalf("%s not found: %s", name, err)
+		}
+	}
+	masterPort, replicaPort, sentinelPort := freePort(t), freePort(t), freePort(t)
+	masterAddress := net.JoinHostPort("127.0.0.1", masterPort)
+	replicaAddress := net.JoinHostPort("127.0.0.1", replicaPort)
+	sentinelAddress := net.JoinHostPort("127.0.0.1", sentinelPort)
+	master := startProcess(t, "redis-server", "--port", masterPort, "--save", "", "--appendonly", "no")
+	startProcess(t, "redis-server", "--port", replicaPort, "--save", "", "--appendonly", "no",
+		"--replicaof", "127.0.0.1", masterPort)
+	sentinelConf := filepath.Join(t.TempDir(), "sentinel.conf")
+	if err := os.WriteFile(sentinelConf, []byte(fmt.Sprintf(`port %s
+sentinel monitor %s 127.0.0.1 %s 1
+sentinel down-after-milliseconds %[2]s 500
+sentinel failover-timeout %[2]s 5000
+`, sentinelPort, sentinelMasterName, masterPort)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	startProcess(t, "redis-sentinel", sentinelConf)
+	waitFor(t, 10*time.Second, func() error { return pingRedis(masterAddress) })
+	waitFor(t, 10*time.Second, func() error { return pingRedis(replicaAddress) })
+	waitFor(t, 10*time.Second, func() error {
+		address, err := sentinelMaster(sentinelAddress)
+		if err == nil && address != masterAddress {
+			err = fmt.Errorf("unexpected master: %s", address)
+		}
+		return err
+	})
+
+	config := NewConfiguration()
+	config.RedisMode = RedisModeSentinel
+	config.RedisMasterName = sentinelMasterName
+	config.RedisAddresses = []string{sentinelAddress}
+	config.RedisUsername, config.RedisPassword = "", ""
+	config.MutexName = "failover"
+	config.RetryInterval = 10 * time.Millisecond
+	config.MutexExpiration = time.Minute
+	mutex, err := NewRedisMutex(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mutex.Close()
+	mutex.errorHandler = func(err error) { t.Logf("redis error: %s", err) }
+
+	// the lock is replicated before the master is killed, otherwise it
+	// may be lost (replication is asynchronous)
+	mutex.Lock()
+	if n, err := mutex.redisClient.Do(context.Background(), "WAIT", 1, 5000).Int(); err != nil || n < 1 {
+		t.Fatalf("lock wasn't replicated (replicas: %d): %v", n, err)
+	}
+	if err := master.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 30*time.Second, func() error {
+		address, err := sentinelMaster(sentinelAddress)
+		if err == nil && address != replicaAddress {
+			err = fmt.Errorf("replica not promoted yet, master: %s", address)
+		}
+		return err
+	})
+
+	// unlocking retries until the client reconnects to the new master, it
+	// panics if the lock was lost during the failover
+	unlocked := make(chan struct{})
+	go func() {
+		defer close(unlocked)
+		mutex.Unlock()
+	}()
+	select {
+	case <-unlocked:
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out unlocking after the failover")
+	}
+
+	other, err := NewRedisMutex(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		other.Lock()
+	}()
+	select {
+	case <-locked:
+		other.Unlock()
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out locking after the failover")
+	}
+}
+
+// TestRedisMutexToken verifies that the token of each acquisition is kept
+// by the go routine that acquired it: a holder whose lock expired can't
+// unlock the lock that someone else acquired using the same mutex. It starts
+// a local redis-server process so it's skipped if redis-server isn't found
+func TestRedisMutexToken(t *testing.T) {
+	if _, err := exec.LookPath("redis-server"); err != nil {
+		t.Skip("redis-server not found")
+	}
+	port := freePort(t)
+	address := net.JoinHostPort("127.0.0.1", port)
+	startProcess(t, "redis-server", "--port", port, "--save", "", "--appendonly", "no")
+	waitFor(t, 10*time.Second, func() error { return pingRedis(address) })
+
+	config := NewConfiguration()
+	config.RedisHost, config.RedisPort = "127.0.0.1", port
+	config.RedisUsername, config.RedisPassword = "", ""
+	config.MutexName = "token"
+	config.RetryInterval = 10 * time.Millisecond
+	config.MutexExpiration = 200 * time.Millisecond
+	mutex, err := NewRedisMutex(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mutex.Close()
+	mutex.errorHandler = func(err error) { t.Logf("redis error: %s", err) }
+	unlocked := func(token string) (unlocked bool) {
+		defer func() {
+			unlocked = recover() == nil
+		}()
+		mutex.UnlockToken(token)
+		return
+	}
+
+	// the stale holder's lock expires and it's acquired by someone else
+	stale := mutex.LockToken()
+	holder := mutex.LockToken()
+	if unlocked(stale) {
+		t.Fatal("expected the stale holder's unlock to fail")
+	}
+	token, err := mutex.redisClient.Get(context.Background(), mutex.keys[0]).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != holder {
+		t.Fatalf("expected the lock to be held by %q, got %q", holder, token)
+	}
+	if !unlocked(holder) {
+		t.Fatal("expected the holder's unlock to succeed")
+	}
+
+	// go routines using Lock share the mutex's token, so they hold the
+	// mutex one at a time
+	mutex.Lock()
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		mutex.Lock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected lock to block until unlocked")
+	case <-time.After(config.MutexExpiration / 2):
+	}
+	mutex.Unlock()
+	select {
+	case <-locked:
+		mutex.Unlock()
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out locking")
+	}
+}
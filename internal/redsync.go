@@ -3,21 +3,37 @@ package internal
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	redsync "github.com/go-redsync/redsync/v4"
 	redsyncgoredis "github.com/go-redsync/redsync/v4/redis/goredis/v9"
+	"github.com/pkg/errors"
 	redis "github.com/redis/go-redis/v9"
 )
 
-const hashKeyRedSyncMutex string = "redsync_mutex"
+const (
+	hashKeyRedSyncMutex   string = "redsync_mutex"
+	hashKeyRedSyncWaiters string = "redsync_waiters"
+)
+
+// redSyncValue can be used to generate the value of a redsync mutex, it
+// contains a unique token and the owner of the lock separated by an @
+func redSyncValue(owner string) func() (string, error) {
+	return func() (string, error) {
+		return GenerateID() + "@" + owner, nil
+	}
+}
 
 type RedisRedSyncMutex struct {
 	config struct {
 		retryInterval time.Duration
 	}
 	errorHandler func(error)
-	redisClient  *redis.Client
+	redisClient  redis.UniversalClient
+	waitersKey   string
+	waiterTTL    time.Duration
 	*redsync.Mutex
 }
 
@@ -27,22 +43,21 @@ func NewRedSyncMutex(config *Configuration) (*RedisRedSyncMutex, error) {
 			fmt.Printf("redis error: %s\n", err.Error())
 		},
 	}
-	address := config.RedisHost
-	if config.RedisPort != "" {
-		address = address + ":" + config.RedisPort
+	redisClient, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
 	}
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     address,
-		Password: config.RedisPassword,
-		DB:       config.RedisDatabase,
-	})
 	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		redisClient.Close()
 		return nil, err
 	}
 	redisPool := redsyncgoredis.NewPool(redisClient)
-	redisMutex := redsync.New(redisPool).NewMutex(hashKeyRedSyncMutex,
-		redsync.WithExpiry(config.MutexExpiration))
+	redisMutex := redsync.New(redisPool).NewMutex(hashKeyRedSyncMutex+":"+config.MutexName,
+		redsync.WithExpiry(config.MutexExpiration),
+		redsync.WithGenValueFunc(redSyncValue(GenerateOwner())))
 	r.redisClient, r.Mutex = redisClient, redisMutex
+	r.waitersKey = hashKeyRedSyncWaiters + ":" + config.MutexName
+	r.waiterTTL = config.MutexExpiration + config.RetryInterval
 	r.config.retryInterval = config.RetryInterval
 	return r, nil
 }
@@ -51,7 +66,49 @@ func (r *RedisRedSyncMutex) Close() error {
 	return r.redisClient.Close()
 }
 
+// redSyncWait will register (or remove) a waiter for the mutex, waiters
+// are registered with an expiration such that they'll be removed if the
+// process waiting goes away
+func redSyncWait(ctx context.Context, redisClient redis.UniversalClient,
+	waitersKey, token string, waiterTTL time.Duration, waiting bool) error {
+	if !waiting {
+		return redisClient.ZRem(ctx, waitersKey, token).Err()
+	}
+	pipeline := redisClient.TxPipeline()
+	pipeline.ZAdd(ctx, waitersKey, redis.Z{
+		Score:  float64(time.Now().Add(waiterTTL).UnixMilli()),
+		Member: token,
+	})
+	pipeline.PExpire(ctx, waitersKey, waiterTTL)
+	_, err := pipeline.Exec(ctx)
+	return err
+}
+
+// redSyncError will convert the errors returned by redsync when a lock
+// isn't held into ErrLockNotHeld, redis errors are returned as-is
+func redSyncError(err error) error {
+	var redisError *redsync.RedisError
+
+	if errors.As(err, &redisError) {
+		return err
+	}
+	return ErrLockNotHeld
+}
+
+func (r *RedisRedSyncMutex) wait(token string, waiting bool) {
+	if err := redSyncWait(context.Background(), r.redisClient,
+		r.waitersKey, token, r.waiterTTL, waiting); err != nil {
+		r.errorHandler(err)
+	}
+}
+
 func (r *RedisRedSyncMutex) Lock() {
+	token := GenerateID()
+	if err := r.Mutex.TryLock(); err == nil {
+		return
+	}
+	r.wait(token, true)
+	defer r.wait(token, false)
 	if err := r.Mutex.Lock(); err != nil {
 		r.errorHandler(err)
 	} else {
@@ -61,6 +118,7 @@ func (r *RedisRedSyncMutex) Lock() {
 	defer tRetry.Stop()
 	for {
 		<-tRetry.C
+		r.wait(token, true)
 		if err := r.Mutex.Lock(); err != nil {
 			r.errorHandler(err)
 			continue
@@ -95,3 +153,150 @@ func (r *RedisRedSyncMutex) Unlock() {
 		}
 	}
 }
+
+// RedSyncLocker can be used to acquire locks on behalf of others and to
+// administrate the locks created by RedisRedSyncMutex
+type RedSyncLocker struct {
+	config struct {
+		retryInterval time.Duration
+	}
+	redisClient redis.UniversalClient
+	redSync     *redsync.Redsync
+}
+
+func NewRedSyncLocker(config *Configuration) (*RedSyncLocker, error) {
+	redisClient, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+	r := &RedSyncLocker{
+		redisClient: redisClient,
+		redSync:     redsync.New(redsyncgoredis.NewPool(redisClient)),
+	}
+	r.config.retryInterval = config.RetryInterval
+	return r, nil
+}
+
+func (r *RedSyncLocker) Close() error {
+	return r.redisClient.Close()
+}
+
+func (r *RedSyncLocker) List(ctx context.Context) ([]*LockInfo, error) {
+	keys, err := redisScan(ctx, r.redisClient, hashKeyRedSyncMutex+":*")
+	if err != nil {
+		return nil, err
+	}
+	locks := make([]*LockInfo, 0, len(keys))
+	for _, key := range keys {
+		lock, err := r.Show(ctx, strings.TrimPrefix(key, hashKeyRedSyncMutex+":"))
+		switch {
+		case errors.Is(err, ErrLockNotFound):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+func (r *RedSyncLocker) Show(ctx context.Context, name string) (*LockInfo, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	pipeline := r.redisClient.Pipeline()
+	value := pipeline.Get(ctx, hashKeyRedSyncMutex+":"+name)
+	ttl := pipeline.PTTL(ctx, hashKeyRedSyncMutex+":"+name)
+	waiters := pipeline.ZCount(ctx, hashKeyRedSyncWaiters+":"+name, now, "+inf")
+	if _, err := pipeline.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if errors.Is(value.Err(), redis.Nil) {
+		return nil, ErrLockNotFound
+	}
+	_, owner, _ := strings.Cut(value.Val(), "@")
+	return &LockInfo{
+		Name:    name,
+		Owner:   owner,
+		Token:   value.Val(),
+		TTL:     ttl.Val(),
+		Waiters: int(waiters.Val()),
+	}, nil
+}
+
+func (r *RedSyncLocker) ForceRelease(ctx context.Context, name string) error {
+	n, err := r.redisClient.Del(ctx, hashKeyRedSyncMutex+":"+name).Result()
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return ErrLockNotFound
+	}
+	return nil
+}
+
+func (r *RedSyncLocker) SetTTL(ctx context.Context, name string, ttl time.Duration) error {
+	ok, err := r.redisClient.PExpire(ctx, hashKeyRedSyncMutex+":"+name, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLockNotFound
+	}
+	return nil
+}
+
+func (r *RedSyncLocker) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (string, error) {
+	token := GenerateID()
+	waitersKey, waiterTTL := hashKeyRedSyncWaiters+":"+name, ttl+r.config.retryInterval
+	mutex := r.redSync.NewMutex(hashKeyRedSyncMutex+":"+name,
+		redsync.WithExpiry(ttl),
+		redsync.WithGenValueFunc(func() (string, error) {
+			return token + "@" + owner, nil
+		}))
+	if err := acquire(ctx, r.config.retryInterval, func() (bool, error) {
+		var redisError *redsync.RedisError
+
+		err := mutex.TryLockContext(ctx)
+		if err == nil {
+			// the lock is held so removing the waiter is best effort (it
+			// expires on its own), otherwise the token would be lost and
+			// the lock couldn't be released until it expires
+			if err := redSyncWait(ctx, r.redisClient, waitersKey, token, waiterTTL, false); err != nil {
+				fmt.Printf("error occured while removing the waiter: \"%s\"\n", err)
+			}
+			return true, nil
+		}
+		if errors.As(err, &redisError) {
+			return false, err
+		}
+		return false, redSyncWait(ctx, r.redisClient, waitersKey, token, waiterTTL, true)
+	}, func() error {
+		return redSyncWait(context.Background(), r.redisClient,
+			waitersKey, token, waiterTTL, false)
+	}); err != nil {
+		return "", err
+	}
+	return mutex.Value(), nil
+}
+
+func (r *RedSyncLocker) Renew(ctx context.Context, name, token string, ttl time.Duration) error {
+	mutex := r.redSync.NewMutex(hashKeyRedSyncMutex+":"+name,
+		redsync.WithExpiry(ttl),
+		redsync.WithValue(token))
+	if ok, err := mutex.ExtendContext(ctx); !ok {
+		return redSyncError(err)
+	}
+	return nil
+}
+
+func (r *RedSyncLocker) Release(ctx context.Context, name, token string) error {
+	mutex := r.redSync.NewMutex(hashKeyRedSyncMutex+":"+name,
+		redsync.WithValue(token))
+	if ok, err := mutex.UnlockContext(ctx); !ok {
+		return redSyncError(err)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package internal
+
+import (
+	client "github.com/antonio-alexander/go-blog-distributed-mutex/client"
+)
+
+// newRemoteMutex can be used to create a mutex that's acquired through
+// the lock service (see the serve command)
+func newRemoteMutex(config *Configuration) interface {
+	MutexContext
+	Close() error
+} {
+	return client.NewMutex(client.Configuration{
+		Address:       config.RemoteAddress,
+		Name:          config.MutexName,
+		Owner:         GenerateOwner(),
+		TTL:           config.MutexExpiration,
+		RetryInterval: config.RetryInterval,
+	})
+}
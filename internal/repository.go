@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EmployeeRepository describes how employees are stored, the scenarios
+// only depend on the repository such that they can be run against any
+// storage that provides the same guarantees; all of the functions stop
+// waiting (e.g., for a row lock) once the context is done
+type EmployeeRepository interface {
+	// CreateEmployee will create the employee and return it as stored
+	CreateEmployee(ctx context.Context, employee *Employee) (*Employee, error)
+
+	// ReadEmployee will read the employee with the given email address
+	ReadEmployee(ctx context.Context, emailAddress string) (*Employee, error)
+
+	// UpdateEmployee will update the employee (incrementing its version)
+	// without any concurrency control
+	UpdateEmployee(ctx context.Context, employee *Employee) (*Employee, error)
+
+	// UpdateEmployeeWithLock will lock the employee's row, read it and
+	// update it; it returns the employee as read (while locked) and the
+	// employee after the update
+	UpdateEmployeeWithLock(ctx context.Context, employee *Employee) (*Employee, *Employee, error)
+
+	// UpdateEmployeeWithVersion will update the employee only if its
+	// version is still the given version, otherwise it returns
+	// ErrVersionConflict
+	UpdateEmployeeWithVersion(ctx context.Context, employee *Employee, version int) (*Employee, error)
+
+	// UpdateEmployeeInTransaction will read the employee (without locking
+	// its row) and update it within a single transaction, whether another
+	// transaction can read the same version depends on the isolation level;
+	// it returns the employee as read and the employee after the update
+	UpdateEmployeeInTransaction(ctx context.Context, employee *Employee) (*Employee, *Employee, error)
+
+	// DeleteEmployee will delete the employee with the given email
+	// address, it's not an error if the employee doesn't exist
+	DeleteEmployee(ctx context.Context, emailAddress string) error
+
+	// ListEmployees will list all of the employees
+	ListEmployees(ctx context.Context) ([]*Employee, error)
+
+	// Close will close the repository
+	Close() error
+}
+
+// newRepository will create the employee repository for the configuration
+func newRepository(config *Configuration) (EmployeeRepository, error) {
+	switch config.EmployeeStore {
+	default:
+		return nil, errors.Errorf("unsupported employee store: %q", config.EmployeeStore)
+	case EmployeeStoreMysql:
+		return NewMysqlRepository(config)
+	case EmployeeStoreMemory:
+		return NewMemoryRepository(config.MemoryLatency, config.SqlTimeout), nil
+	case EmployeeStoreSqlite:
+		return NewSqliteRepository(config)
+	}
+}
+
+// withTimeout returns a context limited to the timeout, the context is
+// returned as is if there's no timeout
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// sleep will sleep for the given duration or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retriesKey is the context key of the retry counter
+type retriesKey struct{}
+
+// withRetries returns a context that counts the retries of the calls made
+// with it (e.g., transactions retried after a deadlock) such that they can
+// be reported by the caller without changing the repository's interface
+func withRetries(ctx context.Context, retries *atomic.Int64) context.Context {
+	return context.WithValue(ctx, retriesKey{}, retries)
+}
+
+// countRetry will count a retry if the context has a retry counter
+func countRetry(ctx context.Context) {
+	if retries, ok := ctx.Value(retriesKey{}).(*atomic.Int64); ok {
+		retries.Add(1)
+	}
+}
+
+// deadlocksKey is the context key of the deadlock counter
+type deadlocksKey struct{}
+
+// withDeadlocks returns a context that counts the deadlocks encountered by
+// the calls made with it, including the deadlocks that were retried
+func withDeadlocks(ctx context.Context, deadlocks *atomic.Int64) context.Context {
+	return context.WithValue(ctx, deadlocksKey{}, deadlocks)
+}
+
+// countDeadlock will count a deadlock if the context has a deadlock counter
+func countDeadlock(ctx context.Context) {
+	if deadlocks, ok := ctx.Value(deadlocksKey{}).(*atomic.Int64); ok {
+		deadlocks.Add(1)
+	}
+}
+
+// backoff returns how long to wait before the given (zero based) retry,
+// the backoff grows exponentially up to the maximum and is jittered so
+// that conflicting retries are spread out
+func backoff(retry int, initial, maximum time.Duration) time.Duration {
+	if initial <= 0 {
+		return 0
+	}
+	d := initial
+	for i := 0; i < retry && d < maximum; i++ {
+		d *= 2
+	}
+	d = min(d, maximum)
+	return d/2 + rand.N(d/2+1)
+}
+
+// UpdateEmployeeWithRetry will read the employee, apply the mutation and
+// update the employee using the version read (compare and swap); if the
+// version is no longer current, it'll re-read the employee, re-apply the
+// mutation and retry (with backoff) up to maxRetries times. It returns the
+// employee as read before the successful update, the employee after the
+// update and the number of retries
+func UpdateEmployeeWithRetry(ctx context.Context, repository EmployeeRepository, emailAddress string, mutateFx func(*Employee),
+	maxRetries int, initialBackoff, maxBackoff time.Duration) (*Employee, *Employee, int, error) {
+	for retry := 0; ; retry++ {
+		employeeRead, err := repository.ReadEmployee(ctx, emailAddress)
+		if err != nil {
+			return nil, nil, retry, err
+		}
+		employee := *employeeRead
+		mutateFx(&employee)
+		employeeUpdated, err := repository.UpdateEmployeeWithVersion(ctx, &employee, employeeRead.Version)
+		if err == nil {
+			return employeeRead, employeeUpdated, retry, nil
+		}
+		if !errors.Is(err, ErrVersionConflict) || retry >= maxRetries {
+			return nil, nil, retry, err
+		}
+		if err := sleep(ctx, backoff(retry, initialBackoff, maxBackoff)); err != nil {
+			return nil, nil, retry, err
+		}
+	}
+}
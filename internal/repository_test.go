@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for name, test := range map[string]struct {
+		retry            int
+		initial, maximum time.Duration
+		low, high        time.Duration
+	}{
+		"disabled":       {retry: 3, initial: 0, maximum: time.Second},
+		"negative":       {retry: 3, initial: -time.Millisecond, maximum: time.Second},
+		"first_retry":    {retry: 0, initial: 10 * time.Millisecond, maximum: time.Second, low: 5 * time.Millisecond, high: 10 * time.Millisecond},
+		"doubled":        {retry: 3, initial: 10 * time.Millisecond, maximum: time.Second, low: 40 * time.Millisecond, high: 80 * time.Millisecond},
+		"capped":         {retry: 10, initial: 10 * time.Millisecond, maximum: 100 * time.Millisecond, low: 50 * time.Millisecond, high: 100 * time.Millisecond},
+		"capped_initial": {retry: 0, initial: time.Second, maximum: 100 * time.Millisecond, low: 50 * time.Millisecond, high: 100 * time.Millisecond},
+		"no_overflow":    {retry: 1000, initial: time.Millisecond, maximum: time.Minute, low: 30 * time.Second, high: time.Minute},
+		"one_nanosecond": {retry: 0, initial: time.Nanosecond, maximum: time.Second, low: 0, high: time.Nanosecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the jitter is random, so the bounds are checked for many samples
+			for range 1000 {
+				if d := backoff(test.retry, test.initial, test.maximum); d < test.low || d > test.high {
+					t.Fatalf("expected backoff within [%s, %s], got %s", test.low, test.high, d)
+				}
+			}
+		})
+	}
+}
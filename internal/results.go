@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	LoadClosed string = "closed"
+	LoadOpen   string = "open"
+)
+
+const (
+	OutputText string = "text"
+	OutputJSON string = "json"
+	OutputCSV  string = "csv"
+)
+
+// BackendNone is the backend of the results of a scenario that doesn't
+// use the mutex (the results don't depend on the mutex type)
+const BackendNone string = "n/a"
+
+// LatencyStats summarizes the latency of successful mutations
+type LatencyStats struct {
+	Count int64         `json:"count"`
+	Min   time.Duration `json:"min_ns"`
+	Mean  time.Duration `json:"mean_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	P999  time.Duration `json:"p99_9_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+// Latencies describes the latency of successful mutations, the latency is
+// split into the time spent waiting for the lock and the time spent in the
+// critical section (lock wait is only known for scenarios that implement
+// TimedScenario, otherwise the whole mutation is the critical section);
+// with an open load, the latency is measured from the time the mutation
+// was intended to start
+type Latencies struct {
+	Latency         LatencyStats `json:"latency"`
+	LockWait        LatencyStats `json:"lock_wait"`
+	CriticalSection LatencyStats `json:"critical_section"`
+
+	latency         Histogram
+	lockWait        Histogram
+	criticalSection Histogram
+}
+
+// record will record the latency of a single mutation, the latency
+// includes the time the mutation was queued (open load)
+func (l *Latencies) record(latency, queued, lockWait time.Duration, timed bool) {
+	l.latency.Record(latency)
+	if timed {
+		l.lockWait.Record(lockWait)
+	}
+	l.criticalSection.Record(latency - queued - lockWait)
+}
+
+// merge will merge the histograms of the given latencies
+func (l *Latencies) merge(latencies *Latencies) {
+	l.latency.Merge(&latencies.latency)
+	l.lockWait.Merge(&latencies.lockWait)
+	l.criticalSection.Merge(&latencies.criticalSection)
+}
+
+// summarize will calculate the latency stats from the histograms
+func (l *Latencies) summarize() {
+	l.Latency = l.latency.Stats()
+	l.LockWait = l.lockWait.Stats()
+	l.CriticalSection = l.criticalSection.Stats()
+}
+
+// GoRoutineResult describes the outcome of a single go routine, retries
+// are the mutations retried by the scenario (e.g., after a version
+// conflict) and tx retries the transactions retried by the repository
+// (e.g., after a deadlock)
+type GoRoutineResult struct {
+	Process         int `json:"process"`
+	GoRoutine       int `json:"go_routine"`
+	Mutations       int `json:"mutations"`
+	Errors          int `json:"errors"`
+	Inconsistencies int `json:"inconsistencies"`
+	Retries         int `json:"retries"`
+	TxRetries       int `json:"tx_retries"`
+	Deadlocks       int `json:"deadlocks"`
+	Latencies
+
+	history History
+}
+
+// Result describes the outcome of running a scenario, the totals are
+// aggregated across all go routines; with an open load, scheduled is the
+// number of mutations scheduled, queued the number of mutations that had
+// to wait for a go routine and missed the number of mutations that were
+// never started (the queue was full or the run ended); deadlocks is the
+// number of times the database rolled back a deadlocked transaction
+// (whether or not the transaction was retried) and tx retries the number of transactions that were retried
+// (retries per success only includes the scenario's retries); interrupted is true if the run was interrupted (by a
+// signal) before the duration elapsed
+type Result struct {
+	Scenario          string        `json:"scenario"`
+	Mode              string        `json:"mode"`
+	Backend           string        `json:"backend"`
+	IsolationLevel    string        `json:"isolation_level,omitempty"`
+	Load              string        `json:"load"`
+	Rate              float64       `json:"rate,omitempty"`
+	Processes         int           `json:"processes"`
+	GoRoutines        int           `json:"go_routines"`
+	Interval          time.Duration `json:"interval_ns"`
+	WallTime          time.Duration `json:"wall_time_ns"`
+	Throughput        float64       `json:"throughput"`
+	Scheduled         int           `json:"scheduled,omitempty"`
+	Missed            int           `json:"missed,omitempty"`
+	Queued            int           `json:"queued,omitempty"`
+	Mutations         int           `json:"mutations"`
+	Errors            int           `json:"errors"`
+	Inconsistencies   int           `json:"inconsistencies"`
+	Retries           int           `json:"retries"`
+	RetriesPerSuccess float64       `json:"retries_per_success"`
+	TxRetries         int           `json:"tx_retries"`
+	Deadlocks         int           `json:"deadlocks"`
+	Interrupted       bool          `json:"interrupted,omitempty"`
+	Latencies
+	GoRoutineResults []*GoRoutineResult     `json:"go_routine_results"`
+	Linearizability  *LinearizabilityResult `json:"linearizability,omitempty"`
+}
+
+// aggregate will calculate the totals from the go routine results, the
+// throughput is the number of successful mutations per second
+func (r *Result) aggregate() {
+	r.Mutations, r.Errors, r.Inconsistencies, r.Retries, r.TxRetries, r.Deadlocks = 0, 0, 0, 0, 0, 0
+	r.Latencies = Latencies{}
+	for _, goRoutineResult := range r.GoRoutineResults {
+		goRoutineResult.summarize()
+		r.Mutations += goRoutineResult.Mutations
+		r.Errors += goRoutineResult.Errors
+		r.Inconsistencies += goRoutineResult.Inconsistencies
+		r.Retries += goRoutineResult.Retries
+		r.TxRetries += goRoutineResult.TxRetries
+		r.Deadlocks += goRoutineResult.Deadlocks
+		r.merge(&goRoutineResult.Latencies)
+	}
+	r.summarize()
+	r.RetriesPerSuccess = 0
+	if r.Mutations > 0 {
+		r.RetriesPerSuccess = float64(r.Retries) / float64(r.Mutations)
+	}
+	r.Throughput = 0
+	if r.WallTime > 0 {
+		r.Throughput = float64(r.Mutations) / r.WallTime.Seconds()
+	}
+}
+
+// checkLinearizability will check if the combined history of all go
+// routines is linearizable
+func (r *Result) checkLinearizability() {
+	var history History
+
+	for _, goRoutineResult := range r.GoRoutineResults {
+		history = append(history, goRoutineResult.history...)
+	}
+	r.Linearizability = CheckLinearizability(history)
+}
+
+// WriteResults can be used to write results in the given output format
+// (text, json or csv); the csv output contains one row per go routine
+// and an additional row (process and go routine "all") with the totals
+func WriteResults(w io.Writer, output string, results []*Result) error {
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case OutputText:
+		for _, result := range results {
+			printResult(w, result)
+		}
+		return nil
+	case OutputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", " ")
+		return encoder.Encode(results)
+	case OutputCSV:
+		writer := csv.NewWriter(w)
+		header := []string{
+			"scenario", "mode", "backend", "isolation_level", "load", "rate", "processes",
+			"go_routines", "interval_ns", "wall_time_ns", "throughput", "scheduled", "missed",
+			"queued", "linearizable", "process", "go_routine", "mutations", "errors",
+			"inconsistencies", "retries", "tx_retries", "deadlocks",
+		}
+		for _, prefix := range []string{"latency", "lock_wait", "critical_section"} {
+			for _, stat := range []string{"count", "min_ns", "mean_ns", "p50_ns", "p90_ns", "p99_ns", "p99_9_ns", "max_ns"} {
+				header = append(header, prefix+"_"+stat)
+			}
+		}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		for _, result := range results {
+			linearizable := ""
+			if result.Linearizability != nil {
+				linearizable = strconv.FormatBool(result.Linearizability.Linearizable)
+			}
+			row := func(process, goRoutine string, mutations, errors, inconsistencies, retries, txRetries, deadlocks int, latencies *Latencies) []string {
+				row := []string{
+					result.Scenario, result.Mode, result.Backend, result.IsolationLevel, result.Load,
+					strconv.FormatFloat(result.Rate, 'f', 3, 64),
+					strconv.Itoa(result.Processes),
+					strconv.Itoa(result.GoRoutines),
+					strconv.FormatInt(int64(result.Interval), 10),
+					strconv.FormatInt(int64(result.WallTime), 10),
+					strconv.FormatFloat(result.Throughput, 'f', 3, 64),
+					strconv.Itoa(result.Scheduled),
+					strconv.Itoa(result.Missed),
+					strconv.Itoa(result.Queued),
+					linearizable,
+					process, goRoutine,
+					strconv.Itoa(mutations),
+					strconv.Itoa(errors),
+					strconv.Itoa(inconsistencies),
+					strconv.Itoa(retries),
+					strconv.Itoa(txRetries),
+					strconv.Itoa(deadlocks),
+				}
+				for _, stats := range []LatencyStats{latencies.Latency, latencies.LockWait, latencies.CriticalSection} {
+					row = append(row, strconv.FormatInt(stats.Count, 10))
+					for _, value := range []time.Duration{stats.Min, stats.Mean, stats.P50,
+						stats.P90, stats.P99, stats.P999, stats.Max} {
+						row = append(row, strconv.FormatInt(int64(value), 10))
+					}
+				}
+				return row
+			}
+			for _, g := range result.GoRoutineResults {
+				if err := writer.Write(row(strconv.Itoa(g.Process), strconv.Itoa(g.GoRoutine), g.Mutations,
+					g.Errors, g.Inconsistencies, g.Retries, g.TxRetries, g.Deadlocks, &g.Latencies)); err != nil {
+					return err
+				}
+			}
+			if err := writer.Write(row("all", "all", result.Mutations, result.Errors,
+				result.Inconsistencies, result.Retries, result.TxRetries, result.Deadlocks, &result.Latencies)); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+}
+
+// printLatencyStats will print the percentiles of the latency stats
+func printLatencyStats(w io.Writer, name string, stats LatencyStats) {
+	if stats.Count == 0 {
+		return
+	}
+	fmt.Fprintf(w, " %s (p50/p90/p99/p99.9/max): %s/%s/%s/%s/%s\n", name,
+		stats.P50, stats.P90, stats.P99, stats.P999, stats.Max)
+}
+
+// printResult will print the result in the same format as the demos
+// and benchmarks have always been printed
+func printResult(w io.Writer, result *Result) {
+	for _, g := range result.GoRoutineResults {
+		if result.Processes > 1 {
+			fmt.Fprintf(w, "process [%d] ", g.Process)
+		}
+		switch result.Mode {
+		case "demo":
+			fmt.Fprintf(w, "go routine [%d]:\n total mutations: %d\n data inconsistencies: %d\n total errors: %d\n",
+				g.GoRoutine, g.Mutations, g.Inconsistencies, g.Errors)
+		case "benchmark":
+			average := "-"
+			if g.Mutations > 0 {
+				average = g.Latency.Mean.String()
+			}
+			fmt.Fprintf(w, "go routine [%d]:\n total mutations: %d\n average time: %s\n total errors: %d\n",
+				g.GoRoutine, g.Mutations, average, g.Errors)
+			printLatencyStats(w, "latency", g.Latency)
+			printLatencyStats(w, "lock wait", g.LockWait)
+			printLatencyStats(w, "critical section", g.CriticalSection)
+		}
+	}
+	if result.Mode == "benchmark" || result.Processes > 1 || result.Load == LoadOpen {
+		fmt.Fprintf(w, "all go routines:\n total mutations: %d\n data inconsistencies: %d\n total errors: %d\n throughput: %.3f/s\n",
+			result.Mutations, result.Inconsistencies, result.Errors, result.Throughput)
+		if result.Retries > 0 {
+			fmt.Fprintf(w, " total retries: %d\n retries per success: %.3f\n",
+				result.Retries, result.RetriesPerSuccess)
+		}
+		if result.TxRetries > 0 {
+			fmt.Fprintf(w, " transaction retries: %d\n", result.TxRetries)
+		}
+		if result.Deadlocks > 0 {
+			fmt.Fprintf(w, " deadlocks: %d\n", result.Deadlocks)
+		}
+		if result.Load == LoadOpen {
+			fmt.Fprintf(w, " scheduled: %d\n missed: %d\n queued: %d\n",
+				result.Scheduled, result.Missed, result.Queued)
+		}
+		printLatencyStats(w, "latency", result.Latency)
+		printLatencyStats(w, "lock wait", result.LockWait)
+		printLatencyStats(w, "critical section", result.CriticalSection)
+	}
+	if result.Linearizability != nil {
+		printLinearizability(w, result.Linearizability)
+	}
+	if result.Interrupted {
+		fmt.Fprintln(w, "interrupted")
+	}
+}
+
+// interrupted returns true if the last result was interrupted, the runs
+// that remain are skipped once interrupted
+func interrupted(results []*Result) bool {
+	return len(results) > 0 && results[len(results)-1].Interrupted
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestResultRetries(t *testing.T) {
+	result := &Result{
+		Scenario: "version-retry",
+		Mode:     "benchmark",
+		WallTime: time.Second,
+		GoRoutineResults: []*GoRoutineResult{
+			{GoRoutine: 0, Mutations: 4, Retries: 2, TxRetries: 1},
+			{GoRoutine: 1, Mutations: 4, Retries: 0, TxRetries: 3},
+		},
+	}
+	result.aggregate()
+	if result.Retries != 2 || result.TxRetries != 4 {
+		t.Fatalf("expected 2 retries and 4 tx retries, got %d and %d", result.Retries, result.TxRetries)
+	}
+	if result.RetriesPerSuccess != 0.25 {
+		t.Fatalf("expected 0.25 retries per success, got %v", result.RetriesPerSuccess)
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := WriteResults(buffer, OutputCSV, []*Result{result}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(buffer).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, test := range []struct {
+		row                int
+		retries, txRetries string
+	}{
+		{row: 1, retries: "2", txRetries: "1"},
+		{row: 2, retries: "0", txRetries: "3"},
+		{row: 3, retries: "2", txRetries: "4"},
+	} {
+		record := records[test.row]
+		if record[columns["retries"]] != test.retries || record[columns["tx_retries"]] != test.txRetries {
+			t.Fatalf("row %d: expected retries %s and tx retries %s, got %s and %s", test.row, test.retries,
+				test.txRetries, record[columns["retries"]], record[columns["tx_retries"]])
+		}
+	}
+}
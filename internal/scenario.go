@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ScenarioEnvironment provides the resources that are available to a
+// scenario during setup
+type ScenarioEnvironment struct {
+	Config     *Configuration
+	Repository EmployeeRepository
+	Employee   *Employee
+}
+
+// Scenario describes a strategy for concurrently mutating an employee,
+// scenarios are executed by the demo and benchmark runners
+type Scenario interface {
+	// Name returns the unique name of the scenario (e.g., row-lock)
+	Name() string
+
+	// Description returns a short description of the scenario
+	Description() string
+
+	// Setup is executed once before the scenario is run
+	Setup(env *ScenarioEnvironment) error
+
+	// Mutate will mutate the employee once, it returns the employee as
+	// read before the mutation and the employee after the mutation; the
+	// context is canceled if the run is interrupted
+	Mutate(ctx context.Context, goRoutine int) (*Employee, *Employee, error)
+
+	// Consistent returns true if the employee before and after the
+	// mutation describe a consistent mutation
+	Consistent(employeeRead, employeeUpdated *Employee) bool
+
+	// Teardown is executed once after the scenario is run
+	Teardown() error
+}
+
+// TimedScenario can optionally be implemented by a scenario that can tell
+// the time spent waiting for a lock apart from the time spent in the
+// critical section; the runners will use MutateTimed instead of Mutate
+type TimedScenario interface {
+	Scenario
+
+	// MutateTimed will mutate the employee once, in addition to Mutate it
+	// returns how long the mutation waited for the lock
+	MutateTimed(ctx context.Context, goRoutine int) (*Employee, *Employee, time.Duration, error)
+}
+
+// RetryingScenario can optionally be implemented by a scenario that retries
+// mutations (e.g., on a version conflict); the runners will report the
+// number of retries
+type RetryingScenario interface {
+	Scenario
+
+	// Retries returns the total number of retries by the go routine
+	Retries(goRoutine int) int
+}
+
+// MutexScenario can optionally be implemented by a scenario to tell if it
+// uses the configured mutex; the results of a scenario that doesn't are
+// independent of the mutex type and are reported with the backend n/a
+type MutexScenario interface {
+	Scenario
+
+	// UsesMutex returns true if the scenario uses the configured mutex
+	UsesMutex() bool
+}
+
+// scenarioBackend returns the backend the results of the scenario are
+// reported with, scenarios are assumed to use the mutex unless they tell
+// otherwise
+func scenarioBackend(config *Configuration, scenario Scenario) string {
+	if mutexScenario, ok := scenario.(MutexScenario); ok && !mutexScenario.UsesMutex() {
+		return BackendNone
+	}
+	return config.MutexType
+}
+
+var scenarioRegistry struct {
+	sync.Mutex
+	scenarios []Scenario
+}
+
+// RegisterScenario can be used to register a scenario such that it can
+// be selected and executed by the run command, scenarios are executed in
+// the order they're registered
+func RegisterScenario(scenario Scenario) error {
+	scenarioRegistry.Lock()
+	defer scenarioRegistry.Unlock()
+
+	for _, s := range scenarioRegistry.scenarios {
+		if s.Name() == scenario.Name() {
+			return errors.Errorf("scenario already registered: %q", scenario.Name())
+		}
+	}
+	scenarioRegistry.scenarios = append(scenarioRegistry.scenarios, scenario)
+	return nil
+}
+
+// Scenarios returns all of the registered scenarios
+func Scenarios() []Scenario {
+	scenarioRegistry.Lock()
+	defer scenarioRegistry.Unlock()
+
+	return append([]Scenario{}, scenarioRegistry.scenarios...)
+}
+
+func printBanner(title string) {
+	fmt.Printf("\n%[1]s\n--%[2]s--\n%[1]s\n", strings.Repeat("=", len(title)+4), title)
+}
+
+func init() {
+	for _, scenario := range []Scenario{
+		&noMutexScenario{},
+		&mutexScenario{},
+		&transactionScenario{},
+		&rowLockScenario{},
+		&versionScenario{},
+		&versionRetryScenario{},
+	} {
+		if err := RegisterScenario(scenario); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// versionConsistent is the default consistency check, a mutation is
+// consistent if the version increments by exactly one
+func versionConsistent(employeeRead, employeeUpdated *Employee) bool {
+	return employeeUpdated.Version == employeeRead.Version+1
+}
+
+type noMutexScenario struct {
+	repository EmployeeRepository
+	employee   *Employee
+}
+
+func (s *noMutexScenario) Name() string { return "no-mutex" }
+
+func (s *noMutexScenario) Description() string { return "Concurrent Mutate with no Mutex" }
+
+func (s *noMutexScenario) UsesMutex() bool { return false }
+
+func (s *noMutexScenario) Setup(env *ScenarioEnvironment) error {
+	s.repository, s.employee = env.Repository, env.Employee
+	return nil
+}
+
+func (s *noMutexScenario) Mutate(ctx context.Context, goRoutine int) (*Employee, *Employee, error) {
+	employeeRead, err := s.repository.ReadEmployee(ctx, s.employee.EmailAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	employeeUpdated, err := s.repository.UpdateEmployee(ctx, s.employee)
+	if err != nil {
+		return nil, nil, err
+	}
+	return employeeRead, employeeUpdated, nil
+}
+
+func (s *noMutexScenario) Consistent(employeeRead, employeeUpdated *Employee) bool {
+	return versionConsistent(employeeRead, employeeUpdated)
+}
+
+func (s *noMutexScenario) Teardown() error { return nil }
+
+// lockMutex will lock the mutex and return the function that unlocks it,
+// if the mutex is a TokenMutex, the token of this acquisition is used to
+// unlock it (the mutex is shared by the go routines)
+func lockMutex(mutex Mutex) (unlock func()) {
+	if mutex, ok := mutex.(TokenMutex); ok {
+		token := mutex.LockToken()
+		return func() { mutex.UnlockToken(token) }
+	}
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+type mutexScenario struct {
+	repository EmployeeRepository
+	employee   *Employee
+	mutex      interface {
+		Mutex
+		Close() error
+	}
+}
+
+func (s *mutexScenario) Name() string { return "mutex" }
+
+func (s *mutexScenario) Description() string { return "Concurrent Mutate with Mutex" }
+
+func (s *mutexScenario) UsesMutex() bool { return true }
+
+func (s *mutexScenario) Setup(env *ScenarioEnvironment) error {
+	mutex, err := newMutex(env.Config)
+	if err != nil {
+		return err
+	}
+	s.repository, s.employee, s.mutex = env.Repository, env.Employee, mutex
+	return nil
+}
+
+func (s *mutexScenario) Mutate(ctx context.Context, goRoutine int) (*Employee, *Employee, error) {
+	employeeRead, employeeUpdated, _, err := s.MutateTimed(ctx, goRoutine)
+	return employeeRead, employeeUpdated, err
+}
+
+func (s *mutexScenario) MutateTimed(ctx context.Context, goRoutine int) (*Employee, *Employee, time.Duration, error) {
+	tStart := time.Now()
+	unlock := lockMutex(s.mutex)
+	defer unlock()
+	lockWait := time.Since(tStart)
+
+	employeeRead, err := s.repository.ReadEmployee(ctx, s.employee.EmailAddress)
+	if err != nil {
+		return nil, nil, lockWait, err
+	}
+	employeeUpdated, err := s.repository.UpdateEmployee(ctx, s.employee)
+	if err != nil {
+		return nil, nil, lockWait, err
+	}
+	return employeeRead, employeeUpdated, lockWait, nil
+}
+
+func (s *mutexScenario) Consistent(employeeRead, employeeUpdated *Employee) bool {
+	return versionConsistent(employeeRead, employeeUpdated)
+}
+
+func (s *mutexScenario) Teardown() error {
+	return s.mutex.Close()
+}
+
+type transactionScenario struct {
+	repository EmployeeRepository
+	employee   *Employee
+}
+
+func (s *transactionScenario) Name() string { return "transaction" }
+
+func (s *transactionScenario) Description() string {
+	return "Concurrent Mutate within a Transaction"
+}
+
+func (s *transactionScenario) UsesMutex() bool { return false }
+
+func (s *transactionScenario) Setup(env *ScenarioEnvironment) error {
+	s.repository, s.employee = env.Repository, env.Employee
+	return nil
+}
+
+func (s *transactionScenario) Mutate(ctx context.Context, goRoutine int) (*Employee, *Employee, error) {
+	return s.repository.UpdateEmployeeInTransaction(ctx, s.employee)
+}
+
+func (s *transactionScenario) Consistent(employeeRead, employeeUpdated *Employee) bool {
+	return versionConsistent(employeeRead, employeeUpdated)
+}
+
+func (s *transactionScenario) Teardown() error { return nil }
+
+type rowLockScenario struct {
+	repository EmployeeRepository
+	employee   *Employee
+}
+
+func (s *rowLockScenario) Name() string { return "row-lock" }
+
+func (s *rowLockScenario) Description() string { return "Concurrent Mutate with Row Lock" }
+
+func (s *rowLockScenario) UsesMutex() bool { return false }
+
+func (s *rowLockScenario) Setup(env *ScenarioEnvironment) error {
+	s.repository, s.employee = env.Repository, env.Employee
+	return nil
+}
+
+func (s *rowLockScenario) Mutate(ctx context.Context, goRoutine int) (*Employee, *Employee, error) {
+	return s.repository.UpdateEmployeeWithLock(ctx, s.employee)
+}
+
+func (s *rowLockScenario) Consistent(employeeRead, employeeUpdated *Employee) bool {
+	return versionConsistent(employeeRead, employeeUpdated)
+}
+
+func (s *rowLockScenario) Teardown() error { return nil }
+
+type versionScenario struct {
+	repository EmployeeRepository
+	employee   *Employee
+}
+
+func (s *versionScenario) Name() string { return "version" }
+
+func (s *versionScenario) Description() string { return "Concurrent Mutate with Version" }
+
+func (s *versionScenario) UsesMutex() bool { return false }
+
+func (s *versionScenario) Setup(env *ScenarioEnvironment) error {
+	s.repository, s.employee = env.Repository, env.Employee
+	return nil
+}
+
+func (s *versionScenario) Mutate(ctx context.Context, goRoutine int) (*Employee, *Employee, error) {
+	employeeRead, err := s.repository.ReadEmployee(ctx, s.employee.EmailAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	employeeUpdated, err := s.repository.UpdateEmployeeWithVersion(ctx, s.employee, employeeRead.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return employeeRead, employeeUpdated, nil
+}
+
+func (s *versionScenario) Consistent(employeeRead, employeeUpdated *Employee) bool {
+	return versionConsistent(employeeRead, employeeUpdated)
+}
+
+func (s *versionScenario) Teardown() error { return nil }
+
+type versionRetryScenario struct {
+	sync.Mutex
+	repository EmployeeRepository
+	employee   *Employee
+	config     *Configuration
+	retries    map[int]int
+}
+
+func (s *versionRetryScenario) Name() string { return "version-retry" }
+
+func (s *versionRetryScenario) Description() string {
+	return "Concurrent Mutate with Version (and Retries)"
+}
+
+func (s *versionRetryScenario) UsesMutex() bool { return false }
+
+func (s *versionRetryScenario) Setup(env *ScenarioEnvironment) error {
+	s.repository, s.employee, s.config = env.Repository, env.Employee, env.Config
+	s.retries = make(map[int]int)
+	return nil
+}
+
+func (s *versionRetryScenario) Mutate(ctx context.Context, goRoutine int) (*Employee, *Employee, error) {
+	employeeRead, employeeUpdated, retries, err := UpdateEmployeeWithRetry(ctx, s.repository,
+		s.employee.EmailAddress, func(employee *Employee) {
+			employee.FirstName, employee.LastName = s.employee.FirstName, s.employee.LastName
+		}, s.config.CasRetries, s.config.CasBackoff, s.config.CasMaxBackoff)
+	s.Lock()
+	s.retries[goRoutine] += retries
+	s.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return employeeRead, employeeUpdated, nil
+}
+
+func (s *versionRetryScenario) Retries(goRoutine int) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.retries[goRoutine]
+}
+
+func (s *versionRetryScenario) Consistent(employeeRead, employeeUpdated *Employee) bool {
+	return versionConsistent(employeeRead, employeeUpdated)
+}
+
+func (s *versionRetryScenario) Teardown() error { return nil }
@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultLockTimeout is how long an acquire request will wait for
+// a lock if the request doesn't provide a timeout
+const defaultLockTimeout time.Duration = 30 * time.Second
+
+// minLockTTL is the shortest time to live that can be requested, the
+// backends have a resolution of a millisecond and leases are renewed at
+// a third of their time to live
+const minLockTTL time.Duration = 3 * time.Millisecond
+
+// shutdownTimeout is how long the servers are given to finish in-flight
+// requests once interrupted
+const shutdownTimeout time.Duration = 10 * time.Second
+
+// LockRequest describes the body of a request to acquire, renew or
+// release a lock; durations are in milliseconds
+type LockRequest struct {
+	Owner   string `json:"owner,omitempty"`
+	Token   string `json:"token,omitempty"`
+	TTL     int64  `json:"ttl_ms,omitempty"`
+	Timeout int64  `json:"timeout_ms,omitempty"`
+}
+
+// LockResponse describes the state of a lock as returned by the
+// lock service; durations are in milliseconds
+type LockResponse struct {
+	Name    string `json:"name"`
+	Owner   string `json:"owner,omitempty"`
+	Token   string `json:"token,omitempty"`
+	TTL     int64  `json:"ttl_ms"`
+	Waiters int    `json:"waiters"`
+}
+
+// ErrorResponse describes the body of a failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// LockServer exposes a Locker over http such that services that can't
+// (or won't) use the mutexes directly can acquire, renew and release
+// locks; waiting for a lock is done by long-polling
+type LockServer struct {
+	config struct {
+		mutexExpiration time.Duration
+	}
+	locker interface {
+		Locker
+		LockAdmin
+	}
+	*http.ServeMux
+}
+
+func NewLockServer(config *Configuration, locker interface {
+	Locker
+	LockAdmin
+}) *LockServer {
+	s := &LockServer{
+		locker:   locker,
+		ServeMux: http.NewServeMux(),
+	}
+	s.config.mutexExpiration = config.MutexExpiration
+	s.HandleFunc("GET /locks", s.list)
+	s.HandleFunc("POST /locks/{name}", s.acquire)
+	s.HandleFunc("PUT /locks/{name}", s.renew)
+	s.HandleFunc("DELETE /locks/{name}", s.release)
+	s.HandleFunc("GET /locks/{name}", s.status)
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	statusCode := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrLockNotFound):
+		statusCode = http.StatusNotFound
+	case errors.Is(err, ErrLockNotHeld):
+		statusCode = http.StatusConflict
+	case errors.Is(err, context.DeadlineExceeded):
+		statusCode, err = http.StatusLocked, errors.New("timed out waiting for lock")
+	case errors.Is(err, context.Canceled):
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJSON(w, statusCode, &ErrorResponse{Error: err.Error()})
+}
+
+// decodeLockRequest will decode the lock request from the body (if
+// present), any query parameters will take precedence
+func decodeLockRequest(r *http.Request) (*LockRequest, error) {
+	request := &LockRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			return nil, err
+		}
+	}
+	query := r.URL.Query()
+	if owner := query.Get("owner"); owner != "" {
+		request.Owner = owner
+	}
+	if token := query.Get("token"); token != "" {
+		request.Token = token
+	}
+	for key, value := range map[string]*int64{
+		"ttl_ms":     &request.TTL,
+		"timeout_ms": &request.Timeout,
+	} {
+		if s := query.Get(key); s != "" {
+			i, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q", key, s)
+			}
+			*value = i
+		}
+	}
+	if request.TTL < 0 || request.Timeout < 0 {
+		return nil, errors.New("durations must not be negative")
+	}
+	return request, nil
+}
+
+func (s *LockServer) ttl(request *LockRequest) (time.Duration, error) {
+	if request.TTL <= 0 {
+		return s.config.mutexExpiration, nil
+	}
+	ttl := time.Duration(request.TTL) * time.Millisecond
+	if ttl < minLockTTL {
+		return 0, fmt.Errorf("ttl must be at least %s", minLockTTL)
+	}
+	return ttl, nil
+}
+
+func (s *LockServer) list(w http.ResponseWriter, r *http.Request) {
+	locks, err := s.locker.List(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	responses := make([]*LockResponse, 0, len(locks))
+	for _, lock := range locks {
+		responses = append(responses, &LockResponse{
+			Name:    lock.Name,
+			Owner:   lock.Owner,
+			TTL:     lock.TTL.Milliseconds(),
+			Waiters: lock.Waiters,
+		})
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+func (s *LockServer) acquire(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	request, err := decodeLockRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	timeout := defaultLockTimeout
+	if request.Timeout > 0 {
+		timeout = time.Duration(request.Timeout) * time.Millisecond
+	}
+	if request.Owner == "" {
+		request.Owner = r.RemoteAddr
+	}
+	ttl, err := s.ttl(request)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	token, err := s.locker.Acquire(ctx, name, request.Owner, ttl)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &LockResponse{
+		Name:  name,
+		Owner: request.Owner,
+		Token: token,
+		TTL:   ttl.Milliseconds(),
+	})
+}
+
+func (s *LockServer) renew(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	request, err := decodeLockRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if request.Token == "" {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: "token is required"})
+		return
+	}
+	ttl, err := s.ttl(request)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := s.locker.Renew(r.Context(), name, request.Token, ttl); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &LockResponse{
+		Name:  name,
+		Token: request.Token,
+		TTL:   ttl.Milliseconds(),
+	})
+}
+
+func (s *LockServer) release(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	request, err := decodeLockRequest(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if request.Token == "" {
+		writeJSON(w, http.StatusBadRequest, &ErrorResponse{Error: "token is required"})
+		return
+	}
+	if err := s.locker.Release(r.Context(), name, request.Token); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *LockServer) status(w http.ResponseWriter, r *http.Request) {
+	lock, err := s.locker.Show(r.Context(), r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &LockResponse{
+		Name:    lock.Name,
+		Owner:   lock.Owner,
+		TTL:     lock.TTL.Milliseconds(),
+		Waiters: lock.Waiters,
+	})
+}
+
+func mainServe(config *Configuration, args []string, chOsSignal chan os.Signal) error {
+	flagSet := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flagSet.StringVar(&config.HttpAddress, "address", config.HttpAddress, "the address to listen on for http (empty to disable)")
+	flagSet.StringVar(&config.GrpcAddress, "grpc-address", config.GrpcAddress, "the address to listen on for grpc (empty to disable)")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if config.HttpAddress == "" && config.GrpcAddress == "" {
+		return errors.New("at least one of address or grpc-address is required")
+	}
+	locker, err := newLocker(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := locker.Close(); err != nil {
+			fmt.Printf("error occured while closing the locker: \"%s\"\n", err)
+		}
+	}()
+	chErr := make(chan error, 2)
+	if config.HttpAddress != "" {
+		server := &http.Server{
+			Addr:    config.HttpAddress,
+			Handler: NewLockServer(config, locker),
+		}
+		go func() {
+			chErr <- server.ListenAndServe()
+		}()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				fmt.Printf("error occured while shutting down the http server: \"%s\"\n", err)
+			}
+		}()
+		fmt.Printf("lock server (%s) listening on %s (http)\n", config.MutexType, config.HttpAddress)
+	}
+	if config.GrpcAddress != "" {
+		listener, err := net.Listen("tcp", config.GrpcAddress)
+		if err != nil {
+			return err
+		}
+		server := newGrpcServer()
+		NewGrpcLockServer(config, locker).Register(server)
+		go func() {
+			chErr <- server.Serve(listener)
+		}()
+		defer stopGrpcServer(server, shutdownTimeout)
+		fmt.Printf("lock server (%s) listening on %s (grpc)\n", config.MutexType, config.GrpcAddress)
+	}
+	select {
+	case err := <-chErr:
+		return err
+	case <-chOsSignal:
+		return nil
+	}
+}
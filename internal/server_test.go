@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// serverTestLock is a lock held by the serverTestLocker, released is
+// closed once the lock is released
+type serverTestLock struct {
+	owner, token string
+	ttl          time.Duration
+	released     chan struct{}
+}
+
+// serverTestLocker is a locker whose acquire waits (like the backends)
+// until the lock is released or the context is done
+type serverTestLocker struct {
+	sync.Mutex
+	locks   map[string]*serverTestLock
+	waiters map[string]int
+}
+
+func newServerTestLocker() *serverTestLocker {
+	return &serverTestLocker{
+		locks:   make(map[string]*serverTestLock),
+		waiters: make(map[string]int),
+	}
+}
+
+func (l *serverTestLocker) Acquire(ctx context.Context, name, owner string, ttl time.Duration) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	for {
+		lock, ok := l.locks[name]
+		if !ok {
+			token := GenerateID()
+			l.locks[name] = &serverTestLock{owner: owner, token: token,
+				ttl: ttl, released: make(chan struct{})}
+			return token, nil
+		}
+		l.waiters[name]++
+		l.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-lock.released:
+		}
+		l.Lock()
+		l.waiters[name]--
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (l *serverTestLocker) Renew(ctx context.Context, name, token string, ttl time.Duration) error {
+	l.Lock()
+	defer l.Unlock()
+
+	lock, ok := l.locks[name]
+	if !ok || lock.token != token {
+		return ErrLockNotHeld
+	}
+	lock.ttl = ttl
+	return nil
+}
+
+func (l *serverTestLocker) Release(ctx context.Context, name, token string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	lock, ok := l.locks[name]
+	if !ok || lock.token != token {
+		return ErrLockNotHeld
+	}
+	delete(l.locks, name)
+	close(lock.released)
+	return nil
+}
+
+func (l *serverTestLocker) List(ctx context.Context) ([]*LockInfo, error) {
+	l.Lock()
+	names := make([]string, 0, len(l.locks))
+	for name := range l.locks {
+		names = append(names, name)
+	}
+	l.Unlock()
+	sort.Strings(names)
+	locks := make([]*LockInfo, 0, len(names))
+	for _, name := range names {
+		lock, err := l.Show(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+func (l *serverTestLocker) Show(ctx context.Context, name string) (*LockInfo, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	lock, ok := l.locks[name]
+	if !ok {
+		return nil, ErrLockNotFound
+	}
+	return &LockInfo{
+		Name:    name,
+		Owner:   lock.owner,
+		Token:   lock.token,
+		TTL:     lock.ttl,
+		Waiters: l.waiters[name],
+	}, nil
+}
+
+func (l *serverTestLocker) ForceRelease(ctx context.Context, name string) error {
+	l.Lock()
+	lock, ok := l.locks[name]
+	l.Unlock()
+	if !ok {
+		return ErrLockNotFound
+	}
+	return l.Release(ctx, name, lock.token)
+}
+
+func (l *serverTestLocker) SetTTL(ctx context.Context, name string, ttl time.Duration) error {
+	return nil
+}
+
+// serveLockRequest will serve the request using the lock server and decode
+// the response (if any) into v; the status code is returned
+func serveLockRequest(t *testing.T, server *LockServer, method, target, body string, v any) int {
+	t.Helper()
+
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code == http.StatusNoContent {
+		return recorder.Code
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected a json response, got %q", contentType)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Fatalf("unable to decode %q: %s", recorder.Body.String(), err)
+	}
+	return recorder.Code
+}
+
+func TestLockServerAcquire(t *testing.T) {
+	config := NewConfiguration()
+	for name, test := range map[string]struct {
+		target, body string
+		held         bool
+		statusCode   int
+		owner        string
+		ttl          time.Duration
+	}{
+		"defaults":       {target: "/locks/employee", statusCode: http.StatusOK, owner: "192.0.2.1:1234", ttl: config.MutexExpiration},
+		"body":           {target: "/locks/employee", body: `{"owner":"body","ttl_ms":1000}`, statusCode: http.StatusOK, owner: "body", ttl: time.Second},
+		"query":          {target: "/locks/employee?owner=query&ttl_ms=500", body: `{"owner":"body","ttl_ms":1000}`, statusCode: http.StatusOK, owner: "query", ttl: 500 * time.Millisecond},
+		"minimum_ttl":    {target: "/locks/employee?ttl_ms=3", statusCode: http.StatusOK, owner: "192.0.2.1:1234", ttl: minLockTTL},
+		"ttl_too_short":  {target: "/locks/employee?ttl_ms=2", statusCode: http.StatusBadRequest},
+		"ttl_negative":   {target: "/locks/employee", body: `{"ttl_ms":-1}`, statusCode: http.StatusBadRequest},
+		"ttl_invalid":    {target: "/locks/employee?ttl_ms=abc", statusCode: http.StatusBadRequest},
+		"body_invalid":   {target: "/locks/employee", body: `{`, statusCode: http.StatusBadRequest},
+		"timeout":        {target: "/locks/employee?timeout_ms=10", held: true, statusCode: http.StatusLocked},
+		"timeout_body":   {target: "/locks/employee", body: `{"timeout_ms":10}`, held: true, statusCode: http.StatusLocked},
+		"timeout_not_ms": {target: "/locks/employee?timeout_ms=1.5", statusCode: http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var response LockResponse
+			var errorResponse ErrorResponse
+
+			locker := newServerTestLocker()
+			server := NewLockServer(config, locker)
+			if test.held {
+				if _, err := locker.Acquire(t.Context(), "employee", "holder", time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.statusCode != http.StatusOK {
+				statusCode := serveLockRequest(t, server, http.MethodPost, test.target, test.body, &errorResponse)
+				if statusCode != test.statusCode {
+					t.Fatalf("expected status %d, got %d", test.statusCode, statusCode)
+				}
+				if errorResponse.Error == "" {
+					t.Fatal("expected an error message")
+				}
+				return
+			}
+			statusCode := serveLockRequest(t, server, http.MethodPost, test.target, test.body, &response)
+			if statusCode != test.statusCode {
+				t.Fatalf("expected status %d, got %d", test.statusCode, statusCode)
+			}
+			lock, err := locker.Show(t.Context(), "employee")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Name != "employee" || response.Token != lock.Token {
+				t.Fatalf("expected employee locked with token %q, got %q with %q", lock.Token, response.Name, response.Token)
+			}
+			if response.Owner != test.owner || lock.Owner != test.owner {
+				t.Fatalf("expected owner %q, got %q (response) and %q (locker)", test.owner, response.Owner, lock.Owner)
+			}
+			if response.TTL != test.ttl.Milliseconds() || lock.TTL != test.ttl {
+				t.Fatalf("expected ttl %s, got %dms (response) and %s (locker)", test.ttl, response.TTL, lock.TTL)
+			}
+		})
+	}
+}
+
+func TestLockServerLongPoll(t *testing.T) {
+	locker := newServerTestLocker()
+	server := httptest.NewServer(NewLockServer(NewConfiguration(), locker))
+	defer server.Close()
+	token, err := locker.Acquire(t.Context(), "employee", "holder", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the acquire request waits (long-polls) until the lock is released
+	type result struct {
+		statusCode int
+		response   LockResponse
+		err        error
+	}
+	chResult := make(chan result, 1)
+	go func() {
+		var r result
+
+		defer func() { chResult <- r }()
+		response, err := http.Post(server.URL+"/locks/employee?owner=waiter&timeout_ms=5000", "application/json", nil)
+		if r.err = err; err != nil {
+			return
+		}
+		defer response.Body.Close()
+		r.statusCode, r.err = response.StatusCode, json.NewDecoder(response.Body).Decode(&r.response)
+	}()
+	waitFor(t, 5*time.Second, func() error {
+		lock, err := locker.Show(t.Context(), "employee")
+		if err == nil && lock.Waiters != 1 {
+			err = errors.Errorf("expected 1 waiter, got %d", lock.Waiters)
+		}
+		return err
+	})
+	select {
+	case r := <-chResult:
+		t.Fatalf("expected acquire to wait, got %d", r.statusCode)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := locker.Release(t.Context(), "employee", token); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-chResult:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.statusCode != http.StatusOK || r.response.Owner != "waiter" || r.response.Token == "" || r.response.Token == token {
+			t.Fatalf("expected the waiter to acquire the lock, got %d: %+v", r.statusCode, r.response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for acquire")
+	}
+}
+
+func TestLockServerRenewRelease(t *testing.T) {
+	for name, test := range map[string]struct {
+		method, target, body string
+		statusCode           int
+		released, held       bool
+		ttl                  time.Duration
+	}{
+		"renew":               {method: http.MethodPut, target: "/locks/employee?token=TOKEN&ttl_ms=2000", statusCode: http.StatusOK, held: true, ttl: 2 * time.Second},
+		"renew_body":          {method: http.MethodPut, target: "/locks/employee", body: `{"token":"TOKEN","ttl_ms":3000}`, statusCode: http.StatusOK, held: true, ttl: 3 * time.Second},
+		"renew_default_ttl":   {method: http.MethodPut, target: "/locks/employee?token=TOKEN", statusCode: http.StatusOK, held: true, ttl: NewConfiguration().MutexExpiration},
+		"renew_wrong_token":   {method: http.MethodPut, target: "/locks/employee?token=other", statusCode: http.StatusConflict, held: true, ttl: time.Minute},
+		"renew_missing_token": {method: http.MethodPut, target: "/locks/employee", statusCode: http.StatusBadRequest, held: true, ttl: time.Minute},
+		"renew_ttl_too_short": {method: http.MethodPut, target: "/locks/employee?token=TOKEN&ttl_ms=1", statusCode: http.StatusBadRequest, held: true, ttl: time.Minute},
+		"renew_not_held":      {method: http.MethodPut, target: "/locks/employee?token=TOKEN", statusCode: http.StatusConflict, released: true},
+		"release":             {method: http.MethodDelete, target: "/locks/employee?token=TOKEN", statusCode: http.StatusNoContent},
+		"release_body":        {method: http.MethodDelete, target: "/locks/employee", body: `{"token":"TOKEN"}`, statusCode: http.StatusNoContent},
+		"release_wrong_token": {method: http.MethodDelete, target: "/locks/employee?token=other", statusCode: http.StatusConflict, held: true, ttl: time.Minute},
+		"release_no_token":    {method: http.MethodDelete, target: "/locks/employee", statusCode: http.StatusBadRequest, held: true, ttl: time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var response LockResponse
+			var errorResponse ErrorResponse
+
+			locker := newServerTestLocker()
+			server := NewLockServer(NewConfiguration(), locker)
+			token, err := locker.Acquire(t.Context(), "employee", "holder", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.released {
+				if err := locker.Release(t.Context(), "employee", token); err != nil {
+					t.Fatal(err)
+				}
+			}
+			target, body := strings.ReplaceAll(test.target, "TOKEN", token), strings.ReplaceAll(test.body, "TOKEN", token)
+			v := any(&response)
+			if test.statusCode != http.StatusOK {
+				v = &errorResponse
+			}
+			if statusCode := serveLockRequest(t, server, test.method, target, body, v); statusCode != test.statusCode {
+				t.Fatalf("expected status %d, got %d", test.statusCode, statusCode)
+			}
+			switch test.statusCode {
+			case http.StatusOK:
+				if response.Name != "employee" || response.Token != token || response.TTL != test.ttl.Milliseconds() {
+					t.Fatalf("unexpected response: %+v", response)
+				}
+			case http.StatusNoContent:
+			default:
+				if errorResponse.Error == "" {
+					t.Fatal("expected an error message")
+				}
+			}
+			lock, err := locker.Show(t.Context(), "employee")
+			if held := err == nil; held != test.held {
+				t.Fatalf("expected held %t, got %t", test.held, held)
+			}
+			if test.held && lock.TTL != test.ttl {
+				t.Fatalf("expected ttl %s, got %s", test.ttl, lock.TTL)
+			}
+		})
+	}
+}
+
+func TestLockServerStatus(t *testing.T) {
+	var response LockResponse
+	var responses []LockResponse
+	var errorResponse ErrorResponse
+
+	locker := newServerTestLocker()
+	server := NewLockServer(NewConfiguration(), locker)
+	if statusCode := serveLockRequest(t, server, http.MethodGet, "/locks/employee", "", &errorResponse); statusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, statusCode)
+	}
+	if errorResponse.Error != ErrLockNotFound.Error() {
+		t.Fatalf("expected %q, got %q", ErrLockNotFound, errorResponse.Error)
+	}
+	if _, err := locker.Acquire(t.Context(), "employee", "holder", 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := locker.Acquire(t.Context(), "manager", "other", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if statusCode := serveLockRequest(t, server, http.MethodGet, "/locks/employee", "", &response); statusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, statusCode)
+	}
+	// the token isn't exposed, it's what proves ownership
+	if response.Name != "employee" || response.Owner != "holder" || response.TTL != 2000 || response.Token != "" {
+		t.Fatalf("unexpected status: %+v", response)
+	}
+	if statusCode := serveLockRequest(t, server, http.MethodGet, "/locks", "", &responses); statusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, statusCode)
+	}
+	if len(responses) != 2 || responses[0].Name != "employee" || responses[1].Name != "manager" {
+		t.Fatalf("unexpected locks: %+v", responses)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	for name, test := range map[string]struct {
+		err        error
+		statusCode int
+		message    string
+	}{
+		"not_found":         {err: ErrLockNotFound, statusCode: http.StatusNotFound, message: ErrLockNotFound.Error()},
+		"not_found_wrapped": {err: errors.Wrap(ErrLockNotFound, "show"), statusCode: http.StatusNotFound, message: "show: lock not found"},
+		"not_held":          {err: ErrLockNotHeld, statusCode: http.StatusConflict, message: ErrLockNotHeld.Error()},
+		"timed_out":         {err: context.DeadlineExceeded, statusCode: http.StatusLocked, message: "timed out waiting for lock"},
+		"canceled":          {err: context.Canceled, statusCode: http.StatusServiceUnavailable, message: context.Canceled.Error()},
+		"other":             {err: errors.New("connection refused"), statusCode: http.StatusInternalServerError, message: "connection refused"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var response ErrorResponse
+
+			recorder := httptest.NewRecorder()
+			writeError(recorder, test.err)
+			if recorder.Code != test.statusCode {
+				t.Fatalf("expected status %d, got %d", test.statusCode, recorder.Code)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Fatalf("expected a json response, got %q", contentType)
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Error != test.message {
+				t.Fatalf("expected %q, got %q", test.message, response.Error)
+			}
+		})
+	}
+}
@@ -1,19 +1,101 @@
 package internal
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"strconv"
+	"time"
 
+	mysql "github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
 )
 
-const tableEmployee string = "employee"
+const (
+	tableEmployee  string = "employee"
+	tlsConfigMysql string = "go_blog_distributed_mutex"
 
-func readEmployee(tx *sql.Tx, emailAddress string) (*Employee, error) {
+	mysqlErrLockWaitTimeout uint16 = 1205
+	mysqlErrDeadlock        uint16 = 1213
+)
+
+// ErrVersionConflict is returned when an employee is updated with a version
+// that's no longer current (it was updated by someone else)
+var ErrVersionConflict = errors.New("update failed; no rows affected")
+
+// LockWaitTimeoutError is returned when mysql gives up waiting for a row
+// lock (innodb_lock_wait_timeout was exceeded)
+type LockWaitTimeoutError struct {
+	Err *mysql.MySQLError
+}
+
+func (e *LockWaitTimeoutError) Error() string {
+	return "innodb_lock_wait_timeout exceeded while waiting for a row lock"
+}
+
+func (e *LockWaitTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// DeadlockError is returned when mysql detects a deadlock and rolls back
+// the transaction (the transaction was chosen as the victim)
+type DeadlockError struct {
+	Err *mysql.MySQLError
+}
+
+func (e *DeadlockError) Error() string {
+	return "deadlock found when trying to get a lock; the transaction was rolled back"
+}
+
+func (e *DeadlockError) Unwrap() error {
+	return e.Err
+}
+
+// mysqlError will convert errors returned by mysql into typed errors
+// where possible, other errors are returned as is
+func mysqlError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return err
+	}
+	switch mysqlErr.Number {
+	default:
+		return err
+	case mysqlErrLockWaitTimeout:
+		return &LockWaitTimeoutError{Err: mysqlErr}
+	case mysqlErrDeadlock:
+		return &DeadlockError{Err: mysqlErr}
+	}
+}
+
+// txOptions will convert the isolation level (as configured) into the
+// transaction options, the default isolation level is the database's
+// default (REPEATABLE READ for mysql)
+func txOptions(isolationLevel string) (*sql.TxOptions, error) {
+	switch isolationLevel {
+	default:
+		return nil, errors.Errorf("unsupported isolation level %q (read-uncommitted, read-committed, repeatable-read or serializable)", isolationLevel)
+	case IsolationLevelDefault:
+		return nil, nil
+	case IsolationLevelReadUncommitted:
+		return &sql.TxOptions{Isolation: sql.LevelReadUncommitted}, nil
+	case IsolationLevelReadCommitted:
+		return &sql.TxOptions{Isolation: sql.LevelReadCommitted}, nil
+	case IsolationLevelRepeatableRead:
+		return &sql.TxOptions{Isolation: sql.LevelRepeatableRead}, nil
+	case IsolationLevelSerializable:
+		return &sql.TxOptions{Isolation: sql.LevelSerializable}, nil
+	}
+}
+
+func readEmployee(ctx context.Context, tx *sql.Tx, emailAddress string) (*Employee, error) {
 	query := fmt.Sprintf("SELECT email_address, first_name, last_name, version FROM %s WHERE email_address=?;", tableEmployee)
-	row := tx.QueryRow(query, emailAddress)
+	row := tx.QueryRowContext(ctx, query, emailAddress)
 	if err := row.Err(); err != nil {
-		return nil, err
+		return nil, mysqlError(err)
 	}
 	employee := &Employee{}
 	if err := row.Scan(
@@ -22,105 +104,173 @@ func readEmployee(tx *sql.Tx, emailAddress string) (*Employee, error) {
 		&employee.LastName,
 		&employee.Version,
 	); err != nil {
-		return nil, err
+		return nil, mysqlError(err)
 	}
 	return employee, nil
 }
 
-func NewSql(config *Configuration) (*sql.DB, error) {
-	dataSourceName := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=%t",
-		config.MysqlUsername, config.MysqlPassword, config.MysqlHost,
-		config.MysqlPort, config.MysqlDatabase, config.MysqlParseTime)
-	db, err := sql.Open("mysql", dataSourceName)
+// tlsConfigName returns the name the tls configuration is registered with,
+// the driver's registry is global so the name is derived from the tls
+// settings; repositories created with different settings don't overwrite
+// each other's configuration
+func tlsConfigName(config *Configuration) string {
+	hash := sha256.New()
+	for _, value := range []string{
+		config.MysqlTLSCAFile,
+		config.MysqlTLSCertFile,
+		config.MysqlTLSKeyFile,
+		config.MysqlTLSServerName,
+		strconv.FormatBool(config.MysqlTLSSkipVerify),
+	} {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	return tlsConfigMysql + "-" + hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// newMysql will open the mysql database, if multiStatements is true, a
+// query may contain multiple statements (e.g., a migration script)
+func newMysql(config *Configuration, multiStatements bool) (*sql.DB, error) {
+	username, err := readCredential(config.MysqlUsername, config.MysqlUsernameFile)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Ping(); err != nil {
-		db.Close()
+	password, err := readCredential(config.MysqlPassword, config.MysqlPasswordFile)
+	if err != nil {
 		return nil, err
 	}
-	return db, nil
-}
-
-func CreateEmployee(db *sql.DB, employee *Employee) (*Employee, error) {
-	if employee == nil {
-		return nil, errors.New("employee is nil")
+	mysqlConfig := mysql.NewConfig()
+	mysqlConfig.User, mysqlConfig.Passwd = username, password
+	mysqlConfig.Net, mysqlConfig.Addr = "tcp", net.JoinHostPort(config.MysqlHost, config.MysqlPort)
+	mysqlConfig.DBName = config.MysqlDatabase
+	mysqlConfig.ParseTime = config.MysqlParseTime
+	mysqlConfig.MultiStatements = multiStatements
+	if config.MysqlLockWaitTimeout > 0 {
+		mysqlConfig.Params = map[string]string{
+			"innodb_lock_wait_timeout": strconv.Itoa(int(config.MysqlLockWaitTimeout.Seconds())),
+		}
 	}
-	tx, err := db.Begin()
+	if config.MysqlTLS {
+		tlsConfig, err := newTLSConfig(config.MysqlTLSCAFile, config.MysqlTLSCertFile,
+			config.MysqlTLSKeyFile, config.MysqlTLSServerName, config.MysqlTLSSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		name := tlsConfigName(config)
+		if err := mysql.RegisterTLSConfig(name, tlsConfig); err != nil {
+			return nil, err
+		}
+		mysqlConfig.TLSConfig = name
+	}
+	db, err := sql.Open("mysql", mysqlConfig.FormatDSN())
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
-
-	query := fmt.Sprintf("INSERT INTO %s (email_address, first_name, last_name) VALUES (?, ?, ?);",
-		tableEmployee)
-	if _, err := tx.Exec(query,
-		employee.EmailAddress, employee.FirstName, employee.LastName); err != nil {
+	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
-	employee, err = readEmployee(tx, employee.EmailAddress)
+	return db, nil
+}
+
+func NewSql(config *Configuration) (*sql.DB, error) {
+	db, err := newMysql(config, false)
 	if err != nil {
 		return nil, err
 	}
-	if err := tx.Commit(); err != nil {
-		return nil, err
+	if config.AutoMigrate {
+		// the migrations are applied using their own connection such
+		// that only the migration scripts can contain multiple statements
+		migrationDB, err := newMysql(config, true)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		err = autoMigrate(config, migrationDB, EmployeeStoreMysql)
+		migrationDB.Close()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
-	return employee, nil
+	return db, nil
+}
+
+// IsRetryable returns true if the error is transient: mysql rolled back the
+// transaction because of a deadlock or gave up waiting for a row lock; the
+// transaction can be retried as is
+func IsRetryable(err error) bool {
+	var deadlockErr *DeadlockError
+	var lockWaitTimeoutErr *LockWaitTimeoutError
+
+	return errors.As(err, &deadlockErr) || errors.As(err, &lockWaitTimeoutErr)
 }
 
-func ReadEmployee(db *sql.DB, emailAddress string) (*Employee, error) {
-	tx, err := db.Begin()
+// runTx will execute the function within a transaction, the transaction is
+// committed if the function succeeds and rolled back otherwise
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fx func(ctx context.Context, tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, opts)
 	if err != nil {
-		return nil, err
+		return mysqlError(err)
 	}
 	defer tx.Rollback()
-	employee, err := readEmployee(tx, emailAddress)
-	if err != nil {
-		return nil, err
+	if err := fx(ctx, tx); err != nil {
+		return err
 	}
 	if err := tx.Commit(); err != nil {
-		return nil, err
+		return mysqlError(err)
 	}
-	return employee, nil
+	return nil
 }
 
-func UpdateEmployee(db *sql.DB, employee *Employee) (*Employee, error) {
-	if employee == nil {
-		return nil, errors.New("employee is nil")
+// RunTx will execute the function within a transaction, if the transaction
+// fails with a retryable error (see IsRetryable) it's rolled back and the
+// function is executed again in a new transaction (with backoff) up to
+// maxRetries times; it returns the number of retries. Every deadlock
+// (whether or not it's retried) is counted if the context has a deadlock
+// counter (see withDeadlocks)
+func RunTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, maxRetries int, initialBackoff, maxBackoff time.Duration,
+	fx func(ctx context.Context, tx *sql.Tx) error) (int, error) {
+	for retry := 0; ; retry++ {
+		err := runTx(ctx, db, opts, fx)
+		var deadlockErr *DeadlockError
+		if errors.As(err, &deadlockErr) {
+			countDeadlock(ctx)
+		}
+		if err == nil || !IsRetryable(err) || retry >= maxRetries {
+			return retry, err
+		}
+		if err := sleep(ctx, backoff(retry, initialBackoff, maxBackoff)); err != nil {
+			return retry, err
+		}
+		countRetry(ctx)
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return nil, err
+}
+
+func createEmployee(ctx context.Context, tx *sql.Tx, employee *Employee) (*Employee, error) {
+	query := fmt.Sprintf("INSERT INTO %s (email_address, first_name, last_name) VALUES (?, ?, ?);",
+		tableEmployee)
+	if _, err := tx.ExecContext(ctx, query,
+		employee.EmailAddress, employee.FirstName, employee.LastName); err != nil {
+		return nil, mysqlError(err)
 	}
-	defer tx.Rollback()
+	return readEmployee(ctx, tx, employee.EmailAddress)
+}
+
+func updateEmployee(ctx context.Context, tx *sql.Tx, employee *Employee) (*Employee, error) {
 	query := fmt.Sprintf("UPDATE %s SET first_name = ?, last_name = ?, version = version+1 WHERE email_address=?;", tableEmployee)
-	if _, err := tx.Exec(query,
+	if _, err := tx.ExecContext(ctx, query,
 		employee.FirstName, employee.LastName, employee.EmailAddress); err != nil {
-		return nil, err
-	}
-	employee, err = readEmployee(tx, employee.EmailAddress)
-	if err != nil {
-		return nil, err
+		return nil, mysqlError(err)
 	}
-	if err := tx.Commit(); err != nil {
-		return nil, err
-	}
-	return employee, nil
+	return readEmployee(ctx, tx, employee.EmailAddress)
 }
 
-func UpdateEmployeeWithLock(db *sql.DB, employee *Employee) (*Employee, *Employee, error) {
-	if employee == nil {
-		return nil, nil, errors.New("employee is nil")
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return nil, nil, err
-	}
-	defer tx.Rollback()
+func updateEmployeeWithLock(ctx context.Context, tx *sql.Tx, employee *Employee) (*Employee, *Employee, error) {
 	query := fmt.Sprintf("SELECT email_address, first_name, last_name, version FROM %s WHERE email_address = ? FOR UPDATE;", tableEmployee)
-	row := tx.QueryRow(query, employee.EmailAddress)
+	row := tx.QueryRowContext(ctx, query, employee.EmailAddress)
 	if err := row.Err(); err != nil {
-		return nil, nil, err
+		return nil, nil, mysqlError(err)
 	}
 	employeeRead := &Employee{}
 	if err := row.Scan(
@@ -129,57 +279,206 @@ func UpdateEmployeeWithLock(db *sql.DB, employee *Employee) (*Employee, *Employe
 		&employeeRead.LastName,
 		&employeeRead.Version,
 	); err != nil {
-		return nil, nil, err
-	}
-	query = fmt.Sprintf("UPDATE %s SET first_name = ?, last_name = ?, version = version+1 WHERE email_address=?;", tableEmployee)
-	if _, err := tx.Exec(query,
-		employee.FirstName, employee.LastName, employee.EmailAddress); err != nil {
-		return nil, nil, err
+		return nil, nil, mysqlError(err)
 	}
-	employeeUpdated, err := readEmployee(tx, employee.EmailAddress)
+	employeeUpdated, err := updateEmployee(ctx, tx, employee)
 	if err != nil {
 		return nil, nil, err
 	}
-	if err := tx.Commit(); err != nil {
-		return nil, nil, err
-	}
 	return employeeRead, employeeUpdated, nil
 }
 
-func UpdateEmployeeWithVersion(db *sql.DB, employee *Employee, version int) (*Employee, error) {
-	if employee == nil {
-		return nil, errors.New("employee is nil")
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback()
+func updateEmployeeWithVersion(ctx context.Context, tx *sql.Tx, employee *Employee, version int) (*Employee, error) {
 	query := fmt.Sprintf("UPDATE %s SET first_name = ?, last_name = ?, version = version+1 WHERE email_address=? AND version=?;", tableEmployee)
-	result, err := tx.Exec(query,
+	result, err := tx.ExecContext(ctx, query,
 		employee.FirstName, employee.LastName, employee.EmailAddress, version)
 	if err != nil {
-		return nil, err
+		return nil, mysqlError(err)
 	}
 	if n, err := result.RowsAffected(); err != nil {
 		return nil, err
 	} else if n <= 0 {
-		return nil, errors.New("update failed; no rows affected")
+		return nil, ErrVersionConflict
+	}
+	return readEmployee(ctx, tx, employee.EmailAddress)
+}
+
+func deleteEmployee(ctx context.Context, tx *sql.Tx, emailAddress string) error {
+	query := fmt.Sprintf("DELETE from %s WHERE email_address=?", tableEmployee)
+	if _, err := tx.ExecContext(ctx, query, emailAddress); err != nil {
+		return mysqlError(err)
+	}
+	return nil
+}
+
+// MysqlRepository is an employee repository backed by mysql, the row lock
+// is implemented with SELECT ... FOR UPDATE; each call is limited to the
+// configured timeout and the transactions use the configured isolation level.
+// Transactions that fail with a retryable error (a deadlock or a lock wait
+// timeout) are retried with backoff, the retries are counted if the context
+// has a retry counter
+type MysqlRepository struct {
+	db         *sql.DB
+	timeout    time.Duration
+	txOptions  *sql.TxOptions
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func NewMysqlRepository(config *Configuration) (*MysqlRepository, error) {
+	opts, err := txOptions(config.IsolationLevel)
+	if err != nil {
+		return nil, err
 	}
-	employee, err = readEmployee(tx, employee.EmailAddress)
+	db, err := NewSql(config)
 	if err != nil {
 		return nil, err
 	}
-	if err := tx.Commit(); err != nil {
+	return &MysqlRepository{
+		db:         db,
+		timeout:    config.SqlTimeout,
+		txOptions:  opts,
+		retries:    config.TxRetries,
+		backoff:    config.TxBackoff,
+		maxBackoff: config.TxMaxBackoff,
+	}, nil
+}
+
+func (m *MysqlRepository) Close() error {
+	return m.db.Close()
+}
+
+// transaction will execute the function within a transaction (retrying it
+// if it fails with a retryable error), the timeout applies to all retries
+func (m *MysqlRepository) transaction(ctx context.Context, fx func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := withTimeout(ctx, m.timeout)
+	defer cancel()
+	_, err := RunTx(ctx, m.db, m.txOptions, m.retries, m.backoff, m.maxBackoff, fx)
+	return err
+}
+
+func (m *MysqlRepository) CreateEmployee(ctx context.Context, employee *Employee) (*Employee, error) {
+	var employeeCreated *Employee
+
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	if err := m.transaction(ctx, func(ctx context.Context, tx *sql.Tx) (err error) {
+		employeeCreated, err = createEmployee(ctx, tx, employee)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return employeeCreated, nil
+}
+
+func (m *MysqlRepository) ReadEmployee(ctx context.Context, emailAddress string) (*Employee, error) {
+	var employee *Employee
+
+	if err := m.transaction(ctx, func(ctx context.Context, tx *sql.Tx) (err error) {
+		employee, err = readEmployee(ctx, tx, emailAddress)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 	return employee, nil
 }
 
-func DeleteEmployee(db *sql.DB, emailAddress string) error {
-	query := fmt.Sprintf("DELETE from %s WHERE email_address=?", tableEmployee)
-	if _, err := db.Exec(query, emailAddress); err != nil {
+func (m *MysqlRepository) UpdateEmployee(ctx context.Context, employee *Employee) (*Employee, error) {
+	var employeeUpdated *Employee
+
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	if err := m.transaction(ctx, func(ctx context.Context, tx *sql.Tx) (err error) {
+		employeeUpdated, err = updateEmployee(ctx, tx, employee)
 		return err
+	}); err != nil {
+		return nil, err
 	}
-	return nil
+	return employeeUpdated, nil
+}
+
+func (m *MysqlRepository) UpdateEmployeeWithLock(ctx context.Context, employee *Employee) (*Employee, *Employee, error) {
+	var employeeRead, employeeUpdated *Employee
+
+	if employee == nil {
+		return nil, nil, errors.New("employee is nil")
+	}
+	if err := m.transaction(ctx, func(ctx context.Context, tx *sql.Tx) (err error) {
+		employeeRead, employeeUpdated, err = updateEmployeeWithLock(ctx, tx, employee)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+	return employeeRead, employeeUpdated, nil
+}
+
+func (m *MysqlRepository) UpdateEmployeeWithVersion(ctx context.Context, employee *Employee, version int) (*Employee, error) {
+	var employeeUpdated *Employee
+
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	if err := m.transaction(ctx, func(ctx context.Context, tx *sql.Tx) (err error) {
+		employeeUpdated, err = updateEmployeeWithVersion(ctx, tx, employee, version)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return employeeUpdated, nil
+}
+
+func (m *MysqlRepository) UpdateEmployeeInTransaction(ctx context.Context, employee *Employee) (*Employee, *Employee, error) {
+	var employeeRead, employeeUpdated *Employee
+
+	if employee == nil {
+		return nil, nil, errors.New("employee is nil")
+	}
+	if err := m.transaction(ctx, func(ctx context.Context, tx *sql.Tx) (err error) {
+		if employeeRead, err = readEmployee(ctx, tx, employee.EmailAddress); err != nil {
+			return err
+		}
+		employeeUpdated, err = updateEmployee(ctx, tx, employee)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+	return employeeRead, employeeUpdated, nil
+}
+
+func (m *MysqlRepository) DeleteEmployee(ctx context.Context, emailAddress string) error {
+	return m.transaction(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		return deleteEmployee(ctx, tx, emailAddress)
+	})
+}
+
+func (m *MysqlRepository) ListEmployees(ctx context.Context) ([]*Employee, error) {
+	var employees []*Employee
+
+	ctx, cancel := withTimeout(ctx, m.timeout)
+	defer cancel()
+	query := fmt.Sprintf("SELECT email_address, first_name, last_name, version FROM %s ORDER BY email_address;", tableEmployee)
+	rows, err := m.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		employee := &Employee{}
+		if err := rows.Scan(
+			&employee.EmailAddress,
+			&employee.FirstName,
+			&employee.LastName,
+			&employee.Version,
+		); err != nil {
+			return nil, err
+		}
+		employees = append(employees, employee)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, mysqlError(err)
+	}
+	return employees, nil
 }
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+func TestRunTx(t *testing.T) {
+	config := NewConfiguration()
+	config.SqliteFile = filepath.Join(t.TempDir(), "run_tx.db")
+	db, err := newSqlite(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	deadlockErr := &DeadlockError{Err: &mysql.MySQLError{Number: mysqlErrDeadlock}}
+	lockWaitTimeoutErr := &LockWaitTimeoutError{Err: &mysql.MySQLError{Number: mysqlErrLockWaitTimeout}}
+	errNotRetryable := errors.New("not retryable")
+	for name, test := range map[string]struct {
+		// errs are returned by the attempts (in order), the attempts
+		// after the last error succeed
+		errs       []error
+		maxRetries int
+		err        error
+		retries    int
+		deadlocks  int
+	}{
+		"success":            {maxRetries: 3},
+		"deadlock_retried":   {errs: []error{deadlockErr, deadlockErr}, maxRetries: 3, retries: 2, deadlocks: 2},
+		"deadlock_exhausted": {errs: []error{deadlockErr, deadlockErr, deadlockErr}, maxRetries: 1, err: deadlockErr, retries: 1, deadlocks: 2},
+		"deadlock_no_retry":  {errs: []error{deadlockErr}, err: deadlockErr, deadlocks: 1},
+		"lock_wait_timeout":  {errs: []error{lockWaitTimeoutErr, lockWaitTimeoutErr}, maxRetries: 3, retries: 2},
+		"mixed":              {errs: []error{lockWaitTimeoutErr, deadlockErr}, maxRetries: 3, retries: 2, deadlocks: 1},
+		"not_retryable":      {errs: []error{errNotRetryable}, maxRetries: 3, err: errNotRetryable},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var retries, deadlocks atomic.Int64
+
+			ctx := withDeadlocks(withRetries(context.Background(), &retries), &deadlocks)
+			attempt := 0
+			n, err := RunTx(ctx, db, nil, test.maxRetries, 0, 0, func(ctx context.Context, tx *sql.Tx) error {
+				defer func() { attempt++ }()
+				if attempt < len(test.errs) {
+					return test.errs[attempt]
+				}
+				return nil
+			})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if n != test.retries || int(retries.Load()) != test.retries {
+				t.Fatalf("expected %d retries, got %d (counted %d)", test.retries, n, retries.Load())
+			}
+			if int(deadlocks.Load()) != test.deadlocks {
+				t.Fatalf("expected %d deadlocks, got %d", test.deadlocks, deadlocks.Load())
+			}
+		})
+	}
+}
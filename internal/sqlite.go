@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteQuerier is implemented by both *sql.DB and *sql.Conn
+type sqliteQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func sqliteReadEmployee(ctx context.Context, q sqliteQuerier, emailAddress string) (*Employee, error) {
+	query := fmt.Sprintf("SELECT email_address, first_name, last_name, version FROM %s WHERE email_address=?;", tableEmployee)
+	row := q.QueryRowContext(ctx, query, emailAddress)
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+	employee := &Employee{}
+	if err := row.Scan(
+		&employee.EmailAddress,
+		&employee.FirstName,
+		&employee.LastName,
+		&employee.Version,
+	); err != nil {
+		return nil, err
+	}
+	return employee, nil
+}
+
+// SqliteRepository is an employee repository backed by sqlite, sqlite
+// doesn't have row locks so the row lock is emulated with BEGIN IMMEDIATE
+// (which takes the database's write lock for the whole transaction); while
+// the write lock is held, other writers wait up to the busy timeout (or
+// until the context is done). The database uses the write-ahead log so
+// readers don't block writers
+type SqliteRepository struct {
+	db          *sql.DB
+	timeout     time.Duration
+	busyTimeout time.Duration
+}
+
+// newSqlite will open the sqlite database, it's created if it doesn't exist
+func newSqlite(config *Configuration) (*sql.DB, error) {
+	values := url.Values{}
+	values.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", config.SqliteBusyTimeout.Milliseconds()))
+	values.Add("_pragma", "journal_mode(WAL)")
+	db, err := sql.Open("sqlite", "file:"+config.SqliteFile+"?"+values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func NewSqliteRepository(config *Configuration) (*SqliteRepository, error) {
+	db, err := newSqlite(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := autoMigrate(config, db, EmployeeStoreSqlite); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SqliteRepository{
+		db:          db,
+		timeout:     config.SqlTimeout,
+		busyTimeout: config.SqliteBusyTimeout,
+	}, nil
+}
+
+func (s *SqliteRepository) Close() error {
+	return s.db.Close()
+}
+
+// setBusyTimeout will set the busy timeout for the connection
+func setBusyTimeout(ctx context.Context, conn *sql.Conn, busyTimeout time.Duration) error {
+	_, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d;", busyTimeout.Milliseconds()))
+	return err
+}
+
+// immediate will execute the function within a transaction started with
+// BEGIN IMMEDIATE, the transaction is committed if the function succeeds.
+// sqlite doesn't interrupt the busy handler when the context is done, so
+// the busy timeout is shortened to the context's deadline while waiting
+// for the write lock
+func (s *SqliteRepository) immediate(ctx context.Context, fx func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, shortened := ctx.Deadline()
+	if shortened = shortened && time.Until(deadline) < s.busyTimeout; shortened {
+		if err := setBusyTimeout(ctx, conn, time.Until(deadline)); err != nil {
+			return err
+		}
+		defer func() { _ = setBusyTimeout(context.Background(), conn, s.busyTimeout) }()
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE;"); err != nil {
+		var sqliteErr *sqlite.Error
+		if shortened && errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+	if err := fx(ctx, conn); err != nil {
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK;")
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT;"); err != nil {
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK;")
+		return err
+	}
+	return nil
+}
+
+func (s *SqliteRepository) CreateEmployee(ctx context.Context, employee *Employee) (*Employee, error) {
+	var employeeCreated *Employee
+
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	if err := s.immediate(ctx, func(ctx context.Context, conn *sql.Conn) error {
+		query := fmt.Sprintf("INSERT INTO %s (email_address, first_name, last_name) VALUES (?, ?, ?);",
+			tableEmployee)
+		if _, err := conn.ExecContext(ctx, query,
+			employee.EmailAddress, employee.FirstName, employee.LastName); err != nil {
+			return err
+		}
+		e, err := sqliteReadEmployee(ctx, conn, employee.EmailAddress)
+		employeeCreated = e
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return employeeCreated, nil
+}
+
+func (s *SqliteRepository) ReadEmployee(ctx context.Context, emailAddress string) (*Employee, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	return sqliteReadEmployee(ctx, s.db, emailAddress)
+}
+
+// update will update the employee (incrementing its version)
+func (s *SqliteRepository) update(ctx context.Context, conn *sql.Conn, employee *Employee) (*Employee, error) {
+	query := fmt.Sprintf("UPDATE %s SET first_name = ?, last_name = ?, version = version+1 WHERE email_address=?;", tableEmployee)
+	if _, err := conn.ExecContext(ctx, query,
+		employee.FirstName, employee.LastName, employee.EmailAddress); err != nil {
+		return nil, err
+	}
+	return sqliteReadEmployee(ctx, conn, employee.EmailAddress)
+}
+
+// updateWithVersion will update the employee (incrementing its version)
+// only if its version matches the given version
+func (s *SqliteRepository) updateWithVersion(ctx context.Context, conn *sql.Conn, employee *Employee, version int) (*Employee, error) {
+	query := fmt.Sprintf("UPDATE %s SET first_name = ?, last_name = ?, version = version+1 WHERE email_address=? AND version=?;", tableEmployee)
+	result, err := conn.ExecContext(ctx, query,
+		employee.FirstName, employee.LastName, employee.EmailAddress, version)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n <= 0 {
+		return nil, ErrVersionConflict
+	}
+	return sqliteReadEmployee(ctx, conn, employee.EmailAddress)
+}
+
+func (s *SqliteRepository) UpdateEmployee(ctx context.Context, employee *Employee) (*Employee, error) {
+	var employeeUpdated *Employee
+
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	if err := s.immediate(ctx, func(ctx context.Context, conn *sql.Conn) (err error) {
+		employeeUpdated, err = s.update(ctx, conn, employee)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return employeeUpdated, nil
+}
+
+func (s *SqliteRepository) UpdateEmployeeWithLock(ctx context.Context, employee *Employee) (*Employee, *Employee, error) {
+	var employeeRead, employeeUpdated *Employee
+
+	if employee == nil {
+		return nil, nil, errors.New("employee is nil")
+	}
+	if err := s.immediate(ctx, func(ctx context.Context, conn *sql.Conn) (err error) {
+		if employeeRead, err = sqliteReadEmployee(ctx, conn, employee.EmailAddress); err != nil {
+			return err
+		}
+		employeeUpdated, err = s.update(ctx, conn, employee)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+	return employeeRead, employeeUpdated, nil
+}
+
+// UpdateEmployeeInTransaction is the same as UpdateEmployeeWithLock, sqlite
+// transactions are serializable (BEGIN IMMEDIATE takes the write lock)
+func (s *SqliteRepository) UpdateEmployeeInTransaction(ctx context.Context, employee *Employee) (*Employee, *Employee, error) {
+	return s.UpdateEmployeeWithLock(ctx, employee)
+}
+
+func (s *SqliteRepository) UpdateEmployeeWithVersion(ctx context.Context, employee *Employee, version int) (*Employee, error) {
+	var employeeUpdated *Employee
+
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	if err := s.immediate(ctx, func(ctx context.Context, conn *sql.Conn) (err error) {
+		employeeUpdated, err = s.updateWithVersion(ctx, conn, employee, version)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return employeeUpdated, nil
+}
+
+func (s *SqliteRepository) DeleteEmployee(ctx context.Context, emailAddress string) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := fmt.Sprintf("DELETE from %s WHERE email_address=?", tableEmployee)
+	if _, err := s.db.ExecContext(ctx, query, emailAddress); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SqliteRepository) ListEmployees(ctx context.Context) ([]*Employee, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := fmt.Sprintf("SELECT email_address, first_name, last_name, version FROM %s ORDER BY email_address;", tableEmployee)
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var employees []*Employee
+	for rows.Next() {
+		employee := &Employee{}
+		if err := rows.Scan(
+			&employee.EmailAddress,
+			&employee.FirstName,
+			&employee.LastName,
+			&employee.Version,
+		); err != nil {
+			return nil, err
+		}
+		employees = append(employees, employee)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return employees, nil
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// newTestSqliteRepository returns a sqlite repository (within a temporary
+// directory) with the employee
+func newTestSqliteRepository(t *testing.T) (*Configuration, *SqliteRepository, *Employee) {
+	t.Helper()
+
+	config := NewConfiguration()
+	config.EmployeeStore = EmployeeStoreSqlite
+	config.SqliteFile = filepath.Join(t.TempDir(), "sqlite.db")
+	repository, err := NewSqliteRepository(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repository.Close() })
+	employee, err := repository.CreateEmployee(context.Background(), newEmployee())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config, repository, employee
+}
+
+func TestSqliteRepositoryRowLock(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	for name, test := range map[string]struct {
+		// update is executed while the write lock is held
+		update func(ctx context.Context, r *SqliteRepository, e *Employee) error
+	}{
+		"update_with_lock": {update: func(ctx context.Context, r *SqliteRepository, e *Employee) error {
+			_, _, err := r.UpdateEmployeeWithLock(ctx, e)
+			return err
+		}},
+		"update": {update: func(ctx context.Context, r *SqliteRepository, e *Employee) error {
+			_, err := r.UpdateEmployee(ctx, e)
+			return err
+		}},
+		"update_in_transaction": {update: func(ctx context.Context, r *SqliteRepository, e *Employee) error {
+			_, _, err := r.UpdateEmployeeInTransaction(ctx, e)
+			return err
+		}},
+		"update_with_version": {update: func(ctx context.Context, r *SqliteRepository, e *Employee) error {
+			_, err := r.UpdateEmployeeWithVersion(ctx, e, e.Version)
+			return err
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, repository, employee := newTestSqliteRepository(t)
+			conn, err := repository.db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE;"); err != nil {
+				t.Fatal(err)
+			}
+
+			// reads don't block while the write lock is held
+			if _, err := repository.ReadEmployee(context.Background(), employee.EmailAddress); err != nil {
+				t.Fatal(err)
+			}
+
+			// while the write lock is held, the update waits until the
+			// context is done
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := test.update(ctx, repository, employee); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected the update to block until the deadline, got %v", err)
+			}
+
+			// otherwise it waits for the lock holder to commit
+			go func() {
+				time.Sleep(timeout)
+				if _, err := conn.ExecContext(context.Background(), "COMMIT;"); err != nil {
+					t.Error(err)
+				}
+			}()
+			tStart := time.Now()
+			if err := test.update(context.Background(), repository, employee); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(tStart); elapsed < timeout {
+				t.Fatalf("the update didn't wait for the lock holder (waited %s)", elapsed)
+			}
+		})
+	}
+}
+
+func TestSqliteRepositoryVersion(t *testing.T) {
+	_, repository, employee := newTestSqliteRepository(t)
+	for _, test := range []struct {
+		name    string
+		email   string
+		version int
+		err     error
+		updated int
+	}{
+		{name: "current", version: employee.Version, updated: employee.Version + 1},
+		{name: "stale", version: employee.Version, err: ErrVersionConflict},
+		{name: "future", version: employee.Version + 2, err: ErrVersionConflict},
+		{name: "current_again", version: employee.Version + 1, updated: employee.Version + 2},
+		{name: "zero", version: 0, err: ErrVersionConflict},
+		{name: "not_found", email: "not.found@example.com", version: 1, err: ErrVersionConflict},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := *employee
+			if test.email != "" {
+				e.EmailAddress = test.email
+			}
+			employeeUpdated, err := repository.UpdateEmployeeWithVersion(context.Background(), &e, test.version)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+			if err == nil && employeeUpdated.Version != test.updated {
+				t.Fatalf("expected version %d, got %d", test.updated, employeeUpdated.Version)
+			}
+		})
+	}
+
+	// the unconditional update doesn't check the version
+	employeeUpdated, err := repository.UpdateEmployee(context.Background(), employee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if employeeUpdated.Version != employee.Version+3 {
+		t.Fatalf("expected version %d, got %d", employee.Version+3, employeeUpdated.Version)
+	}
+
+	// concurrent updates with the same version conflict, only one wins
+	_, repository, employee = newTestSqliteRepository(t)
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = repository.UpdateEmployeeWithVersion(context.Background(), employee, employee.Version)
+		}()
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		switch {
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrVersionConflict):
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one update to succeed, got %d", succeeded)
+	}
+
+	// the employee must exist to be read
+	if _, err := repository.ReadEmployee(context.Background(), "not.found@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected %v, got %v", sql.ErrNoRows, err)
+	}
+}
+
+func TestSqliteRepositoryScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the scenarios in short mode")
+	}
+	// sqlite serializes writers (BEGIN IMMEDIATE) so only the scenario
+	// without a mutex can lose updates, whether it does depends on timing
+	for _, test := range []struct {
+		scenario   string
+		consistent bool
+	}{
+		{scenario: "no-mutex"},
+		{scenario: "transaction", consistent: true},
+		{scenario: "row-lock", consistent: true},
+		{scenario: "version", consistent: true},
+		{scenario: "version-retry", consistent: true},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			var scenario Scenario
+
+			for _, s := range Scenarios() {
+				if s.Name() == test.scenario {
+					scenario = s
+				}
+			}
+			if scenario == nil {
+				t.Fatalf("scenario not registered: %q", test.scenario)
+			}
+			config, repository, employee := newTestSqliteRepository(t)
+			config.GoRoutines = 4
+			config.MutateInterval = time.Millisecond
+			config.DemoDuration = 200 * time.Millisecond
+			env := &ScenarioEnvironment{Config: config, Repository: repository, Employee: employee}
+			results, err := runScenario(config, make(chan os.Signal), env, scenario, "benchmark",
+				runOptions{load: LoadClosed, history: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := results[0]
+			if result.Mutations == 0 {
+				t.Fatal("expected mutations")
+			}
+			if test.consistent && result.Inconsistencies > 0 {
+				t.Fatalf("expected no inconsistencies, got %d", result.Inconsistencies)
+			}
+			// lost updates (two mutations that replaced the same version)
+			// aren't linearizable
+			linearizability := result.Linearizability
+			if linearizability.Linearizable != (result.Inconsistencies == 0) {
+				t.Fatalf("expected linearizable %t, got %+v", result.Inconsistencies == 0, linearizability)
+			}
+		})
+	}
+}
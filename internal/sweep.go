@@ -0,0 +1,347 @@
+package internal
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const usageSweep string = `usage: sweep [flags]
+
+Runs each scenario (as a benchmark) for every combination of go routines,
+intervals and mutex types and prints a comparison table; scenarios that
+don't use the mutex are run once per combination of go routines and
+intervals (with the mutex type n/a).
+
+flags:
+`
+
+// sweepSeries is a single line in a sweep chart: the results of a scenario
+// for a given mutex type and interval, ordered by the number of go routines
+type sweepSeries struct {
+	name    string
+	results []*Result
+}
+
+// errorRate returns the ratio of errors to attempted mutations
+func errorRate(result *Result) float64 {
+	if attempts := result.Mutations + result.Errors; attempts > 0 {
+		return float64(result.Errors) / float64(attempts)
+	}
+	return 0
+}
+
+// sweepSeriesFromResults will group the results into series
+func sweepSeriesFromResults(results []*Result) []*sweepSeries {
+	var series []*sweepSeries
+
+	index := make(map[string]*sweepSeries)
+	for _, result := range results {
+		name := fmt.Sprintf("%s/%s/%s", result.Scenario, result.Backend, result.Interval)
+		s, ok := index[name]
+		if !ok {
+			s = &sweepSeries{name: name}
+			index[name] = s
+			series = append(series, s)
+		}
+		s.results = append(s.results, result)
+	}
+	for _, s := range series {
+		sort.SliceStable(s.results, func(i, j int) bool {
+			return s.results[i].GoRoutines < s.results[j].GoRoutines
+		})
+	}
+	return series
+}
+
+// printSweepTable will print a comparison table of the results
+func printSweepTable(w io.Writer, results []*Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tMUTEX TYPE\tINTERVAL\tGO ROUTINES\tTHROUGHPUT\tP99\tERROR RATE\tRETRIES/SUCCESS\tINCONSISTENCIES")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%.3f/s\t%s\t%.2f%%\t%.3f\t%d\n",
+			result.Scenario, result.Backend, result.Interval, result.GoRoutines,
+			result.Throughput, result.Latency.P99, 100*errorRate(result),
+			result.RetriesPerSuccess, result.Inconsistencies)
+	}
+	return tw.Flush()
+}
+
+// writeSweepChart will write a self-contained html page with a svg chart
+// for the throughput, p99 latency and error rate versus the number of go
+// routines (one line per scenario, mutex type and interval)
+func writeSweepChart(w io.Writer, results []*Result) error {
+	const width, height, margin float64 = 640, 320, 60
+
+	colors := []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+		"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+	series := sweepSeriesFromResults(results)
+	var goRoutines []int
+	seen := make(map[int]bool)
+	for _, result := range results {
+		if !seen[result.GoRoutines] {
+			seen[result.GoRoutines] = true
+			goRoutines = append(goRoutines, result.GoRoutines)
+		}
+	}
+	sort.Ints(goRoutines)
+	charts := []struct {
+		title  string
+		value  func(*Result) float64
+		format func(float64) string
+	}{
+		{"Throughput (mutations/s)", func(r *Result) float64 { return r.Throughput },
+			func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) }},
+		{"p99 Latency", func(r *Result) float64 { return float64(r.Latency.P99) },
+			func(v float64) string { return time.Duration(v).Round(time.Microsecond).String() }},
+		{"Error Rate (%)", func(r *Result) float64 { return 100 * errorRate(r) },
+			func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) }},
+	}
+	// the x axis is logarithmic if the go routines span more than a
+	// factor of ten (e.g., 1, 2, 4, 8, 16, 32)
+	logarithmic := len(goRoutines) > 1 && goRoutines[0] > 0 &&
+		goRoutines[len(goRoutines)-1]/goRoutines[0] >= 10
+	xFx := func(goRoutine int) float64 {
+		if len(goRoutines) <= 1 {
+			return margin + (width-2*margin)/2
+		}
+		low, high := float64(goRoutines[0]), float64(goRoutines[len(goRoutines)-1])
+		value := float64(goRoutine)
+		if logarithmic {
+			low, high, value = math.Log(low), math.Log(high), math.Log(value)
+		}
+		return margin + (width-2*margin)*(value-low)/(high-low)
+	}
+	fmt.Fprintln(w, "<!DOCTYPE html>")
+	fmt.Fprintln(w, `<html><head><meta charset="utf-8"><title>Sweep</title>`)
+	fmt.Fprintln(w, `<style>body{font-family:sans-serif}svg{margin:8px}text{font-size:11px}</style></head><body>`)
+	fmt.Fprintln(w, "<h1>Sweep</h1>")
+	fmt.Fprintln(w, "<ul>")
+	for i, s := range series {
+		fmt.Fprintf(w, "<li><span style=\"color:%s\">&#9632;</span> %s</li>\n",
+			colors[i%len(colors)], html.EscapeString(s.name))
+	}
+	fmt.Fprintln(w, "</ul>")
+	for _, chart := range charts {
+		var maximum float64
+		for _, result := range results {
+			maximum = math.Max(maximum, chart.value(result))
+		}
+		if maximum == 0 {
+			maximum = 1
+		}
+		yFx := func(value float64) float64 {
+			return height - margin/2 - (height-margin)*value/maximum
+		}
+		fmt.Fprintf(w, "<h2>%s</h2>\n", html.EscapeString(chart.title))
+		fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%.0f\" height=\"%.0f\">\n", width, height)
+		fmt.Fprintf(w, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"black\"/>\n",
+			margin, yFx(0), width-margin, yFx(0))
+		fmt.Fprintf(w, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"black\"/>\n",
+			margin, yFx(0), margin, yFx(maximum))
+		for i := 0; i <= 4; i++ {
+			value := maximum * float64(i) / 4
+			fmt.Fprintf(w, "<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"end\">%s</text>\n",
+				margin-4, yFx(value)+4, html.EscapeString(chart.format(value)))
+		}
+		for _, goRoutine := range goRoutines {
+			fmt.Fprintf(w, "<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"middle\">%d</text>\n",
+				xFx(goRoutine), yFx(0)+16, goRoutine)
+		}
+		fmt.Fprintf(w, "<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"middle\">go routines</text>\n",
+			width/2, height-2)
+		for i, s := range series {
+			var points []string
+			for _, result := range s.results {
+				points = append(points, fmt.Sprintf("%.1f,%.1f",
+					xFx(result.GoRoutines), yFx(chart.value(result))))
+			}
+			color := colors[i%len(colors)]
+			fmt.Fprintf(w, "<polyline fill=\"none\" stroke=\"%s\" stroke-width=\"2\" points=\"%s\"/>\n",
+				color, strings.Join(points, " "))
+			for j, point := range points {
+				xy := strings.Split(point, ",")
+				fmt.Fprintf(w, "<circle cx=\"%s\" cy=\"%s\" r=\"3\" fill=\"%s\"><title>%s: %s</title></circle>\n",
+					xy[0], xy[1], color, html.EscapeString(s.name),
+					html.EscapeString(chart.format(chart.value(s.results[j]))))
+			}
+		}
+		fmt.Fprintln(w, "</svg>")
+	}
+	_, err := fmt.Fprintln(w, "</body></html>")
+	return err
+}
+
+// parseList will split a comma separated list, parsing each item
+func parseList[T any](list string, parseFx func(string) (T, error)) ([]T, error) {
+	var items []T
+
+	for _, item := range strings.Split(list, ",") {
+		value, err := parseFx(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+func mainSweep(config *Configuration, args []string, chOsSignal chan os.Signal) error {
+	var goRoutineList, intervalList, mutexTypeList, scenarioList string
+	var output, outputFile, htmlFile string
+
+	employee := newEmployee()
+	flagSet := flag.NewFlagSet("sweep", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprint(flagSet.Output(), usageSweep)
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&goRoutineList, "goroutines", "1,2,4,8,16", "comma separated list of go routine counts")
+	flagSet.StringVar(&intervalList, "interval", config.MutateInterval.String(), "comma separated list of mutate intervals")
+	flagSet.StringVar(&mutexTypeList, "mutex-type", config.MutexType, "comma separated list of mutex types (redis, redis_redshift or remote)")
+	flagSet.StringVar(&scenarioList, "scenario", "", "comma separated list of scenarios to run (default: all)")
+	flagSet.DurationVar(&config.DemoDuration, "duration", config.DemoDuration, "how long each combination runs")
+	flagSet.StringVar(&output, "output", OutputText, "the format of the results (text for a comparison table, json or csv)")
+	flagSet.StringVar(&outputFile, "output-file", "", "the file to write the results to (default: stdout)")
+	flagSet.StringVar(&htmlFile, "html", "", "the file to write a html chart of throughput, p99 latency and error rate to")
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case OutputText, OutputJSON, OutputCSV:
+	}
+	goRoutines, err := parseList(goRoutineList, func(s string) (int, error) {
+		n, err := strconv.Atoi(s)
+		if err == nil && n <= 0 {
+			err = errors.New("goroutines must be positive")
+		}
+		return n, err
+	})
+	if err != nil {
+		return err
+	}
+	intervals, err := parseList(intervalList, func(s string) (time.Duration, error) {
+		d, err := time.ParseDuration(s)
+		if err == nil && d <= 0 {
+			err = errors.New("interval must be positive")
+		}
+		return d, err
+	})
+	if err != nil {
+		return err
+	}
+	mutexTypes, _ := parseList(mutexTypeList, func(s string) (string, error) { return s, nil })
+	if config.DemoDuration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	var scenarios []Scenario
+	selected := make(map[string]bool)
+	if scenarioList != "" {
+		for _, name := range strings.Split(scenarioList, ",") {
+			selected[strings.TrimSpace(name)] = true
+		}
+	}
+	for _, scenario := range Scenarios() {
+		if scenarioList == "" || selected[scenario.Name()] {
+			scenarios = append(scenarios, scenario)
+			delete(selected, scenario.Name())
+		}
+	}
+	for name := range selected {
+		return errors.Errorf("unsupported scenario: %q", name)
+	}
+	repository, err := newRepository(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := repository.Close(); err != nil {
+			fmt.Printf("error occured while closing the database: \"%s\"\n", err)
+		}
+	}()
+	if err := repository.DeleteEmployee(context.Background(), employee.EmailAddress); err != nil {
+		return err
+	}
+	if employee, err = repository.CreateEmployee(context.Background(), employee); err != nil {
+		return err
+	}
+	verbose := output == OutputText || outputFile != ""
+	// scenarios that don't use the mutex are only run once (with the
+	// first mutex type) for each combination, their results don't depend
+	// on the mutex type; the sweep stops once interrupted
+	var results []*Result
+sweep:
+	for _, interval := range intervals {
+		for _, goRoutine := range goRoutines {
+			for _, scenario := range scenarios {
+				for i, mutexType := range mutexTypes {
+					c := *config
+					c.MutexType, c.MutateInterval, c.GoRoutines = mutexType, interval, goRoutine
+					backend := scenarioBackend(&c, scenario)
+					if backend == BackendNone && i > 0 {
+						break
+					}
+					if verbose {
+						fmt.Printf("running %s (mutex: %s, interval: %s, go routines: %d)\n",
+							scenario.Name(), backend, interval, goRoutine)
+					}
+					env := &ScenarioEnvironment{Config: &c, Repository: repository, Employee: employee}
+					scenarioResults, err := runScenario(&c, chOsSignal, env, scenario,
+						"benchmark", runOptions{load: LoadClosed})
+					if err != nil {
+						return err
+					}
+					results = append(results, scenarioResults...)
+					if interrupted(results) {
+						break sweep
+					}
+				}
+			}
+		}
+	}
+	if htmlFile != "" {
+		file, err := os.Create(htmlFile)
+		if err != nil {
+			return err
+		}
+		if err := writeSweepChart(file, results); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	if output != OutputText {
+		return writeResultsFile(output, outputFile, results)
+	}
+	if outputFile == "" {
+		fmt.Println()
+		return printSweepTable(os.Stdout, results)
+	}
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	if err := printSweepTable(file, results); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
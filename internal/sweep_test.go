@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSweep(t *testing.T) {
+	for name, test := range map[string]struct {
+		interrupt bool
+		results   []string
+	}{
+		// scenarios that don't use the mutex are run once per combination
+		"mutex_independent": {results: []string{
+			"no-mutex/n/a/1", "row-lock/n/a/1", "version/n/a/1",
+			"no-mutex/n/a/2", "row-lock/n/a/2", "version/n/a/2",
+		}},
+		"interrupted": {interrupt: true, results: []string{"no-mutex/n/a/1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var results []*Result
+
+			config := NewConfiguration()
+			config.EmployeeStore = EmployeeStoreMemory
+			outputFile := filepath.Join(t.TempDir(), "sweep.json")
+			chOsSignal := make(chan os.Signal, 1)
+			if test.interrupt {
+				chOsSignal <- syscall.SIGINT
+			}
+			if err := mainSweep(config, []string{
+				"--scenario", "no-mutex,row-lock,version",
+				"--mutex-type", "redis,redis_redshift",
+				"--goroutines", "1,2",
+				"--interval", "10ms",
+				"--duration", "50ms",
+				"--output", OutputJSON,
+				"--output-file", outputFile,
+			}, chOsSignal); err != nil {
+				t.Fatal(err)
+			}
+			bytes, err := os.ReadFile(outputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(bytes, &results); err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != len(test.results) {
+				t.Fatalf("expected %d results, got %d", len(test.results), len(results))
+			}
+			for i, result := range results {
+				if name := fmt.Sprintf("%s/%s/%d", result.Scenario, result.Backend,
+					result.GoRoutines); name != test.results[i] {
+					t.Fatalf("result %d: expected %s, got %s", i, test.results[i], name)
+				}
+				if result.Interrupted != test.interrupt {
+					t.Fatalf("result %d: expected interrupted %t", i, test.interrupt)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// newTLSConfig can be used to create a tls configuration from a set of
+// files; the certificate authority is optional (the system pool is used
+// if omitted) and the client certificate/key must be provided together
+func newTLSConfig(caFile, certFile, keyFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if caFile != "" {
+		bytes, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read certificate authority")
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(bytes) {
+			return nil, errors.Errorf("no certificates found in %q", caFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	switch {
+	case certFile != "" && keyFile != "":
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	case certFile != "" || keyFile != "":
+		return nil, errors.New("client certificate and key must be provided together")
+	}
+	return tlsConfig, nil
+}
+
+// readCredential can be used to read a credential (e.g., a docker secret)
+// from a file, if no file is provided, the value is returned as-is
+func readCredential(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read credential")
+	}
+	return strings.TrimRight(string(bytes), "\r\n"), nil
+}
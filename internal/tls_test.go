@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate will create a self-signed certificate and write the
+// certificate and its key (pem encoded) into the directory
+func writeCertificate(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _ := writeCertificate(t, dir, "ca")
+	certFile, keyFile := writeCertificate(t, dir, "client")
+	_, otherKeyFile := writeCertificate(t, dir, "other")
+	notPem := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPem, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.pem")
+
+	for name, test := range map[string]struct {
+		caFile, certFile, keyFile string
+		rootCAs, certificate      bool
+		fail                      bool
+	}{
+		"system_pool":      {},
+		"ca":               {caFile: caFile, rootCAs: true},
+		"ca_missing":       {caFile: missing, fail: true},
+		"ca_not_pem":       {caFile: notPem, fail: true},
+		"certificate":      {certFile: certFile, keyFile: keyFile, certificate: true},
+		"ca_certificate":   {caFile: caFile, certFile: certFile, keyFile: keyFile, rootCAs: true, certificate: true},
+		"cert_without_key": {certFile: certFile, fail: true},
+		"key_without_cert": {keyFile: keyFile, fail: true},
+		"cert_missing":     {certFile: missing, keyFile: keyFile, fail: true},
+		"key_mismatch":     {certFile: certFile, keyFile: otherKeyFile, fail: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(test.caFile, test.certFile, test.keyFile, "mysql.local", true)
+			if test.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tlsConfig.ServerName != "mysql.local" || !tlsConfig.InsecureSkipVerify {
+				t.Fatalf("expected server name and skip verify to be set, got %q and %t",
+					tlsConfig.ServerName, tlsConfig.InsecureSkipVerify)
+			}
+			if rootCAs := tlsConfig.RootCAs != nil; rootCAs != test.rootCAs {
+				t.Fatalf("expected root certificate authorities %t, got %t", test.rootCAs, rootCAs)
+			}
+			if certificate := len(tlsConfig.Certificates) == 1; certificate != test.certificate {
+				t.Fatalf("expected client certificate %t, got %t", test.certificate, certificate)
+			}
+		})
+	}
+}
+
+func TestReadCredential(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	secret := write("secret", "from-file")
+	newline := write("newline", "from-file\n")
+	crlf := write("crlf", "from-file\r\n")
+	empty := write("empty", "")
+
+	for name, test := range map[string]struct {
+		value, file string
+		credential  string
+		fail        bool
+	}{
+		"value":        {value: "from-value", credential: "from-value"},
+		"empty":        {},
+		"file":         {file: secret, credential: "from-file"},
+		"file_wins":    {value: "from-value", file: secret, credential: "from-file"},
+		"newline":      {file: newline, credential: "from-file"},
+		"crlf":         {file: crlf, credential: "from-file"},
+		"empty_file":   {value: "from-value", file: empty, credential: ""},
+		"missing_file": {value: "from-value", file: filepath.Join(dir, "missing"), fail: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			credential, err := readCredential(test.value, test.file)
+			if test.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credential != test.credential {
+				t.Fatalf("expected %q, got %q", test.credential, credential)
+			}
+		})
+	}
+}
+
+func TestTLSConfigName(t *testing.T) {
+	config := &Configuration{MysqlTLSCAFile: "ca.pem", MysqlTLSServerName: "mysql.local"}
+	name := tlsConfigName(config)
+	if name != tlsConfigName(&Configuration{MysqlTLSCAFile: "ca.pem", MysqlTLSServerName: "mysql.local"}) {
+		t.Fatal("expected the same settings to have the same name")
+	}
+	for setting, other := range map[string]*Configuration{
+		"ca":          {MysqlTLSCAFile: "other.pem", MysqlTLSServerName: "mysql.local"},
+		"server_name": {MysqlTLSCAFile: "ca.pem", MysqlTLSServerName: "other.local"},
+		"skip_verify": {MysqlTLSCAFile: "ca.pem", MysqlTLSServerName: "mysql.local", MysqlTLSSkipVerify: true},
+		"boundary":    {MysqlTLSCAFile: "ca.pemmysql.local"},
+	} {
+		if tlsConfigName(other) == name {
+			t.Fatalf("expected a different name when the %s differs", setting)
+		}
+	}
+}
@@ -1,6 +1,85 @@
 package internal
 
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrLockNotFound is returned when attempting to administrate a
+	// lock that isn't currently held
+	ErrLockNotFound = errors.New("lock not found")
+
+	// ErrLockNotHeld is returned when attempting to renew or release
+	// a lock using a token that doesn't currently hold it
+	ErrLockNotHeld = errors.New("lock not held")
+)
+
 type Mutex interface {
 	Lock()
 	Unlock()
 }
+
+// TokenMutex is a mutex that identifies each acquisition with a token, the
+// token returned by LockToken is used to unlock the mutex such that go
+// routines can share the mutex without unlocking each other's locks (e.g.,
+// when a holder's lock expires and someone else acquires it)
+type TokenMutex interface {
+	LockToken() string
+	UnlockToken(token string)
+}
+
+// MutexContext is a mutex whose lock and unlock operations can be
+// cancelled (or given a deadline) using a context
+type MutexContext interface {
+	Mutex
+	LockContext(ctx context.Context) error
+	UnlockContext(ctx context.Context) error
+}
+
+// LockInfo describes the current state of a named lock
+type LockInfo struct {
+	Name    string        `json:"name"`
+	Owner   string        `json:"owner"`
+	Token   string        `json:"token"`
+	TTL     time.Duration `json:"ttl"`
+	Waiters int           `json:"waiters"`
+}
+
+// LockAdmin can be used to inspect and administrate the locks for
+// a given backend regardless of who holds them
+type LockAdmin interface {
+	// List will return all of the locks that are currently held
+	List(ctx context.Context) ([]*LockInfo, error)
+
+	// Show will return the lock with the given name or ErrLockNotFound
+	Show(ctx context.Context, name string) (*LockInfo, error)
+
+	// ForceRelease will release the lock with the given name without
+	// confirming ownership
+	ForceRelease(ctx context.Context, name string) error
+
+	// SetTTL will set the remaining time to live for the lock with
+	// the given name
+	SetTTL(ctx context.Context, name string, ttl time.Duration) error
+}
+
+// Locker can be used to acquire, renew and release named locks on behalf
+// of someone else (e.g., a client of the lock service); the holder of a
+// lock is identified by the token returned when it was acquired
+type Locker interface {
+	// Acquire will block until the lock with the given name is acquired
+	// or the context is done, once acquired, the lock will expire after
+	// the given ttl unless renewed
+	Acquire(ctx context.Context, name, owner string, ttl time.Duration) (string, error)
+
+	// Renew will reset the time to live of the lock with the given name
+	// if held by the given token, otherwise ErrLockNotHeld is returned
+	Renew(ctx context.Context, name, token string, ttl time.Duration) error
+
+	// Release will release the lock with the given name if held by the
+	// given token, otherwise ErrLockNotHeld is returned
+	Release(ctx context.Context, name, token string) error
+}
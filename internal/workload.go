@@ -0,0 +1,462 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	StrategyGlobalMutex string = "global-mutex"
+	StrategyKeyMutex    string = "key-mutex"
+	StrategyRowLock     string = "row-lock"
+	StrategyVersion     string = "version"
+)
+
+const (
+	DistributionUniform string = "uniform"
+	DistributionZipfian string = "zipfian"
+	DistributionHotspot string = "hotspot"
+)
+
+const usageWorkload string = `usage: workload [flags]
+
+Seeds a number of employees and runs each strategy against them, picking
+the employee to mutate using the given distribution.
+
+strategies:
+ global-mutex    a single mutex for all of the employees
+ key-mutex       a mutex per employee
+ row-lock        a row lock (SELECT ... FOR UPDATE)
+ version         an update using the version read
+
+distributions:
+ uniform         every employee is equally likely
+ zipfian         the likelihood of an employee follows a zipfian distribution
+ hotspot         a fraction of the employees receive a fraction of the mutations
+
+flags:
+`
+
+// KeyContention describes the contention on a single employee (key)
+type KeyContention struct {
+	Key             string        `json:"key"`
+	Operations      int           `json:"operations"`
+	Share           float64       `json:"share"`
+	Mutations       int           `json:"mutations"`
+	Errors          int           `json:"errors"`
+	Inconsistencies int           `json:"inconsistencies"`
+	LockWait        time.Duration `json:"lock_wait_mean_ns"`
+
+	lockWaitTotal time.Duration
+}
+
+// WorkloadResult describes the outcome of running a strategy against a
+// workload, the keys are sorted by the number of operations (descending)
+type WorkloadResult struct {
+	Strategy     string           `json:"strategy"`
+	Distribution string           `json:"distribution"`
+	Employees    int              `json:"employees"`
+	Result       *Result          `json:"result"`
+	Keys         []*KeyContention `json:"keys"`
+}
+
+// keyPicker picks the index of the employee to mutate
+type keyPicker struct {
+	sync.Mutex
+	rand            *rand.Rand
+	zipf            *rand.Zipf
+	distribution    string
+	keys            int
+	hotspotKeys     float64
+	hotspotFraction float64
+}
+
+func newKeyPicker(distribution string, keys int, zipfS, hotspotKeys, hotspotFraction float64) (*keyPicker, error) {
+	k := &keyPicker{
+		rand:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		distribution:    distribution,
+		keys:            keys,
+		hotspotKeys:     hotspotKeys,
+		hotspotFraction: hotspotFraction,
+	}
+	switch distribution {
+	default:
+		return nil, errors.Errorf("unsupported distribution: %q", distribution)
+	case DistributionUniform:
+	case DistributionZipfian:
+		if zipfS <= 1 {
+			return nil, errors.New("zipf-s must be greater than 1")
+		}
+		k.zipf = rand.NewZipf(k.rand, zipfS, 1, uint64(keys-1))
+	case DistributionHotspot:
+		if hotspotKeys <= 0 || hotspotKeys >= 1 || hotspotFraction < 0 || hotspotFraction > 1 {
+			return nil, errors.New("hotspot-keys must be between 0 and 1 (exclusive) and hotspot-fraction between 0 and 1")
+		}
+	}
+	return k, nil
+}
+
+// Pick returns the index of the employee to mutate
+func (k *keyPicker) Pick() int {
+	k.Lock()
+	defer k.Unlock()
+
+	switch k.distribution {
+	default:
+		return k.rand.Intn(k.keys)
+	case DistributionZipfian:
+		return int(k.zipf.Uint64())
+	case DistributionHotspot:
+		hot := max(int(math.Round(k.hotspotKeys*float64(k.keys))), 1)
+		if hot >= k.keys || k.rand.Float64() < k.hotspotFraction {
+			return k.rand.Intn(hot)
+		}
+		return hot + k.rand.Intn(k.keys-hot)
+	}
+}
+
+// workloadScenario mutates one of the seeded employees (picked using
+// the distribution) using the strategy
+type workloadScenario struct {
+	sync.Mutex
+	strategy   string
+	employees  []*Employee
+	picker     *keyPicker
+	config     *Configuration
+	repository EmployeeRepository
+	owner      string
+	locker     interface {
+		Locker
+		Close() error
+	}
+	keys []*KeyContention
+}
+
+func (s *workloadScenario) Name() string { return "workload-" + s.strategy }
+
+func (s *workloadScenario) UsesMutex() bool {
+	return s.strategy == StrategyGlobalMutex || s.strategy == StrategyKeyMutex
+}
+
+func (s *workloadScenario) Description() string {
+	return fmt.Sprintf("Concurrent Mutate of %d Employees (%s, %s)",
+		len(s.employees), s.strategy, s.picker.distribution)
+}
+
+func (s *workloadScenario) Setup(env *ScenarioEnvironment) error {
+	s.config, s.repository, s.owner = env.Config, env.Repository, GenerateOwner()
+	s.keys = make([]*KeyContention, len(s.employees))
+	for i, employee := range s.employees {
+		s.keys[i] = &KeyContention{Key: employee.EmailAddress}
+	}
+	switch s.strategy {
+	case StrategyGlobalMutex, StrategyKeyMutex:
+		locker, err := newLocker(env.Config)
+		if err != nil {
+			return err
+		}
+		s.locker = locker
+	}
+	return nil
+}
+
+// lock will acquire the mutex for the strategy and return a function
+// to release it
+func (s *workloadScenario) lock(ctx context.Context, key int) (func() error, error) {
+	name := s.config.MutexName
+	if s.strategy == StrategyKeyMutex {
+		name = fmt.Sprintf("%s:%d", s.config.MutexName, key)
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultLockTimeout)
+	defer cancel()
+	token, err := s.locker.Acquire(ctx, name, s.owner, s.config.MutexExpiration)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultLockTimeout)
+		defer cancel()
+		return s.locker.Release(ctx, name, token)
+	}, nil
+}
+
+func (s *workloadScenario) mutate(ctx context.Context, key int) (*Employee, *Employee, time.Duration, error) {
+	var lockWait time.Duration
+
+	employee := s.employees[key]
+	switch s.strategy {
+	default:
+		return nil, nil, 0, errors.Errorf("unsupported strategy: %q", s.strategy)
+	case StrategyGlobalMutex, StrategyKeyMutex:
+		tStart := time.Now()
+		unlock, err := s.lock(ctx, key)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		lockWait = time.Since(tStart)
+		employeeRead, err := s.repository.ReadEmployee(ctx, employee.EmailAddress)
+		if err != nil {
+			_ = unlock()
+			return nil, nil, lockWait, err
+		}
+		employeeUpdated, err := s.repository.UpdateEmployee(ctx, employee)
+		if err != nil {
+			_ = unlock()
+			return nil, nil, lockWait, err
+		}
+		if err := unlock(); err != nil {
+			return nil, nil, lockWait, err
+		}
+		return employeeRead, employeeUpdated, lockWait, nil
+	case StrategyRowLock:
+		employeeRead, employeeUpdated, err := s.repository.UpdateEmployeeWithLock(ctx, employee)
+		return employeeRead, employeeUpdated, 0, err
+	case StrategyVersion:
+		employeeRead, err := s.repository.ReadEmployee(ctx, employee.EmailAddress)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		employeeUpdated, err := s.repository.UpdateEmployeeWithVersion(ctx, employee, employeeRead.Version)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return employeeRead, employeeUpdated, 0, nil
+	}
+}
+
+func (s *workloadScenario) MutateTimed(ctx context.Context, goRoutine int) (*Employee, *Employee, time.Duration, error) {
+	key := s.picker.Pick()
+	employeeRead, employeeUpdated, lockWait, err := s.mutate(ctx, key)
+	s.Lock()
+	defer s.Unlock()
+	k := s.keys[key]
+	k.Operations++
+	k.lockWaitTotal += lockWait
+	switch {
+	case err != nil:
+		k.Errors++
+	case !versionConsistent(employeeRead, employeeUpdated):
+		k.Inconsistencies++
+		k.Mutations++
+	default:
+		k.Mutations++
+	}
+	return employeeRead, employeeUpdated, lockWait, err
+}
+
+func (s *workloadScenario) Mutate(ctx context.Context, goRoutine int) (*Employee, *Employee, error) {
+	employeeRead, employeeUpdated, _, err := s.MutateTimed(ctx, goRoutine)
+	return employeeRead, employeeUpdated, err
+}
+
+func (s *workloadScenario) Consistent(employeeRead, employeeUpdated *Employee) bool {
+	return versionConsistent(employeeRead, employeeUpdated)
+}
+
+func (s *workloadScenario) Teardown() error {
+	if s.locker != nil {
+		return s.locker.Close()
+	}
+	return nil
+}
+
+// contention returns the contention per key sorted by the number of
+// operations (descending)
+func (s *workloadScenario) contention() []*KeyContention {
+	var operations int
+
+	s.Lock()
+	defer s.Unlock()
+	keys := append([]*KeyContention{}, s.keys...)
+	for _, k := range keys {
+		operations += k.Operations
+	}
+	for _, k := range keys {
+		if operations > 0 {
+			k.Share = float64(k.Operations) / float64(operations)
+		}
+		if k.Operations > 0 {
+			k.LockWait = k.lockWaitTotal / time.Duration(k.Operations)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Operations > keys[j].Operations
+	})
+	return keys
+}
+
+// printWorkloadResults will print a summary of each strategy and the
+// contention of the top keys
+func printWorkloadResults(output string, top int, results []*WorkloadResult) error {
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case OutputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", " ")
+		return encoder.Encode(results)
+	case OutputText:
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STRATEGY\tDISTRIBUTION\tEMPLOYEES\tTHROUGHPUT\tP99\tERROR RATE\tINCONSISTENCIES\tHOTTEST KEY SHARE")
+	for _, result := range results {
+		var share float64
+		if len(result.Keys) > 0 {
+			share = result.Keys[0].Share
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.3f/s\t%s\t%.2f%%\t%d\t%.2f%%\n", result.Strategy,
+			result.Distribution, result.Employees, result.Result.Throughput,
+			result.Result.Latency.P99, 100*errorRate(result.Result),
+			result.Result.Inconsistencies, 100*share)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, result := range results {
+		fmt.Printf("\ncontention (%s, top %d keys):\n", result.Strategy, top)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tOPERATIONS\tSHARE\tMUTATIONS\tERRORS\tINCONSISTENCIES\tLOCK WAIT")
+		for i, k := range result.Keys {
+			if i >= top {
+				break
+			}
+			fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%d\t%d\t%d\t%s\n", k.Key, k.Operations,
+				100*k.Share, k.Mutations, k.Errors, k.Inconsistencies, k.LockWait)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedEmployees will (re)create the given number of employees
+func seedEmployees(repository EmployeeRepository, n int) ([]*Employee, error) {
+	var employees []*Employee
+
+	for i := range n {
+		employee := &Employee{
+			FirstName:    "Employee",
+			LastName:     fmt.Sprint(i),
+			EmailAddress: fmt.Sprintf("employee%d@workload.mistersoftwaredeveloper.com", i),
+		}
+		if err := repository.DeleteEmployee(context.Background(), employee.EmailAddress); err != nil {
+			return nil, err
+		}
+		employee, err := repository.CreateEmployee(context.Background(), employee)
+		if err != nil {
+			return nil, err
+		}
+		employees = append(employees, employee)
+	}
+	return employees, nil
+}
+
+func mainWorkload(config *Configuration, args []string, chOsSignal chan os.Signal) error {
+	var strategyList, distribution, output string
+	var employees, top int
+	var zipfS, hotspotKeys, hotspotFraction float64
+
+	flagSet := flag.NewFlagSet("workload", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprint(flagSet.Output(), usageWorkload)
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&strategyList, "strategy", strings.Join([]string{StrategyGlobalMutex,
+		StrategyKeyMutex, StrategyRowLock, StrategyVersion}, ","), "comma separated list of strategies")
+	flagSet.StringVar(&distribution, "distribution", DistributionUniform, "the distribution used to pick employees (uniform, zipfian or hotspot)")
+	flagSet.IntVar(&employees, "employees", 100, "the number of employees to seed")
+	flagSet.Float64Var(&zipfS, "zipf-s", 1.1, "the exponent of the zipfian distribution (must be greater than 1)")
+	flagSet.Float64Var(&hotspotKeys, "hotspot-keys", 0.2, "the fraction of employees that are hot (hotspot)")
+	flagSet.Float64Var(&hotspotFraction, "hotspot-fraction", 0.8, "the fraction of mutations that go to hot employees (hotspot)")
+	flagSet.IntVar(&top, "top", 10, "the number of keys to show contention for")
+	flagSet.StringVar(&output, "output", OutputText, "the format of the results (text or json)")
+	flagSet.StringVar(&config.MutexType, "mutex-type", config.MutexType, "the type of mutex (redis or redis_redshift)")
+	flagSet.IntVar(&config.GoRoutines, "goroutines", config.GoRoutines, "the number of go routines mutating concurrently")
+	flagSet.DurationVar(&config.DemoDuration, "duration", config.DemoDuration, "how long each strategy runs")
+	flagSet.DurationVar(&config.MutateInterval, "interval", config.MutateInterval, "how often each go routine mutates")
+	if err := flagSet.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	switch output {
+	default:
+		return errors.Errorf("unsupported output: %q", output)
+	case OutputText, OutputJSON:
+	}
+	if employees <= 1 {
+		return errors.New("employees must be greater than one")
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	var strategies []string
+	for _, strategy := range strings.Split(strategyList, ",") {
+		switch strategy = strings.TrimSpace(strategy); strategy {
+		default:
+			return errors.Errorf("unsupported strategy: %q", strategy)
+		case StrategyGlobalMutex, StrategyKeyMutex, StrategyRowLock, StrategyVersion:
+			strategies = append(strategies, strategy)
+		}
+	}
+	if _, err := newKeyPicker(distribution, employees, zipfS, hotspotKeys, hotspotFraction); err != nil {
+		return err
+	}
+	repository, err := newRepository(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := repository.Close(); err != nil {
+			fmt.Printf("error occured while closing the database: \"%s\"\n", err)
+		}
+	}()
+	seeded, err := seedEmployees(repository, employees)
+	if err != nil {
+		return err
+	}
+	verbose := output == OutputText
+	env := &ScenarioEnvironment{Config: config, Repository: repository, Employee: seeded[0]}
+	var results []*WorkloadResult
+	for _, strategy := range strategies {
+		picker, _ := newKeyPicker(distribution, employees, zipfS, hotspotKeys, hotspotFraction)
+		scenario := &workloadScenario{
+			strategy:  strategy,
+			employees: seeded,
+			picker:    picker,
+		}
+		scenarioResults, err := runScenario(config, chOsSignal, env, scenario,
+			"benchmark", runOptions{verbose: verbose, load: LoadClosed})
+		if err != nil {
+			return err
+		}
+		results = append(results, &WorkloadResult{
+			Strategy:     strategy,
+			Distribution: distribution,
+			Employees:    employees,
+			Result:       scenarioResults[0],
+			Keys:         scenario.contention(),
+		})
+		if scenarioResults[0].Interrupted {
+			break
+		}
+	}
+	if verbose {
+		fmt.Println()
+	}
+	return printWorkloadResults(output, top, results)
+}